@@ -25,14 +25,21 @@ import (
 
 func main() {
 	gcs := &repositories.GCSRepo{}
-	config := core.MakeDefaultConfig()
-	gitHub := repositories.CreateGitHubRepo(config.Get("BAZELISK_GITHUB_TOKEN"))
+	config, err := core.MakeDefaultConfig()
+	if err != nil {
+		log.Print(err)
+		os.Exit(core.ExitCodeBazeliskError)
+	}
+	gitHub := repositories.CreateGitHubRepo(core.GetGitHubToken(config))
 	// Fetch LTS releases & candidates, rolling releases and Bazel-at-commits from GCS, forks from GitHub.
 	repos := core.CreateRepositories(gcs, gitHub, gcs, gcs, true)
 
+	// Bazelisk has nothing left to do once Bazel runs, so it may as well get out of the way.
+	core.ExecBazel = true
 	exitCode, err := core.RunBazeliskWithArgsFuncAndConfig(func(string) []string { return os.Args[1:] }, repos, config)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(core.ExitCode(err))
 	}
 	os.Exit(exitCode)
 }
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandSuffix is appended to the name of a config value to get the name of the command that prints the value,
+// e.g. BAZELISK_GITHUB_TOKEN_COMMAND for BAZELISK_GITHUB_TOKEN.
+const CommandSuffix = "_COMMAND"
+
+// CommandTimeout is the maximum amount of time that a command may take to print a config value.
+var CommandTimeout = 30 * time.Second
+
+// WithCommands returns a Config which gets config values from the given Config. If a value is not set, but there is a
+// value with the same name and the suffix "_COMMAND", it runs that command in a shell and uses its (trimmed) output instead.
+// This way secrets such as tokens can come from a password manager instead of plaintext files.
+func WithCommands(config Config) Config {
+	return &withCommands{
+		config: config,
+		values: make(map[string]string),
+	}
+}
+
+type withCommands struct {
+	config Config
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (c *withCommands) Get(name string) string {
+	if value := c.config.Get(name); value != "" || strings.HasSuffix(name, CommandSuffix) {
+		return value
+	}
+	command := c.config.Get(name + CommandSuffix)
+	if command == "" {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, ok := c.values[name]; ok {
+		return value
+	}
+	value, err := runCommand(command)
+	if err != nil {
+		log.Printf("Warning: could not get %s from %s%s: %v", name, name, CommandSuffix, err)
+	}
+	c.values[name] = value
+	return value
+}
+
+func runCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
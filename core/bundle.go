@@ -0,0 +1,375 @@
+package core
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// releasesListingSuffix is appended to the name of a fork to get the file in which the list of its releases on GitHub is cached.
+const releasesListingSuffix = "-releases.json"
+
+// bundleFilter selects the cached binaries that --export_bundle includes. Empty fields match everything.
+type bundleFilter struct {
+	versions  map[string]bool
+	platforms map[string]bool
+	flavors   map[string]bool
+}
+
+// parseMetadataName splits the name of a metadata entry (e.g. "bazel_nojdk-7.4.1-linux-x86_64") into its flavor, version and platform.
+func parseMetadataName(name string) (flavor, version, platform string, ok bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) < 4 {
+		return "", "", "", false
+	}
+	return parts[0], strings.Join(parts[1:len(parts)-2], "-"), strings.Join(parts[len(parts)-2:], "-"), true
+}
+
+func (f *bundleFilter) matches(name string) bool {
+	flavor, version, platform, ok := parseMetadataName(name)
+	if !ok {
+		return false
+	}
+	return (len(f.versions) == 0 || f.versions[version]) &&
+		(len(f.platforms) == 0 || f.platforms[platform]) &&
+		(len(f.flavors) == 0 || f.flavors[flavor])
+}
+
+// parseBundleFilter parses the arguments of --export_bundle, e.g. "--platforms=linux-x86_64,darwin-arm64", "--flavors=bazel_nojdk" and a list of versions.
+func parseBundleFilter(args []string) (*bundleFilter, error) {
+	f := &bundleFilter{versions: make(map[string]bool), platforms: make(map[string]bool), flavors: make(map[string]bool)}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			f.versions[arg] = true
+			continue
+		}
+		name, value, _ := strings.Cut(arg, "=")
+		var set map[string]bool
+		switch name {
+		case "--platforms":
+			set = f.platforms
+		case "--flavors":
+			set = f.flavors
+		default:
+			return nil, fmt.Errorf("unknown option %q for --export_bundle, expected --platforms=<os-arch,...>, --flavors=<flavor,...> or versions", arg)
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				set[v] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// exportBundle writes the cached binaries that match the filter, along with their metadata and the cached lists of releases of their forks,
+// into a .tar.gz file. The paths in the archive are relative to the Bazelisk home directory.
+func exportBundle(bazeliskHome, bundlePath string, filter *bundleFilter, out io.Writer) (int, error) {
+	var files []string
+	digests := make(map[string]bool)
+	forks := make(map[string]bool)
+
+	metadataDir := filepath.Join(bazeliskHome, "downloads", "metadata")
+	err := filepath.WalkDir(metadataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isMetadataEntry(d.Name()) || !filter.matches(d.Name()) {
+			return nil
+		}
+		digest, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		binaries, _ := filepath.Glob(filepath.Join(bazeliskHome, "downloads", "sha256", string(digest), "bin", "bazel*"))
+		if len(binaries) == 0 {
+			return nil
+		}
+		files = append(files, p)
+		if rel, err := filepath.Rel(metadataDir, p); err == nil {
+			forks[strings.Split(filepath.ToSlash(rel), "/")[0]] = true
+		}
+		if !digests[string(digest)] {
+			digests[string(digest)] = true
+			files = append(files, binaries...)
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("could not read %s: %v", metadataDir, err)
+	}
+	if len(digests) == 0 {
+		return -1, errors.New("no cached Bazel binaries match, download them first (e.g. with --prefetch)")
+	}
+
+	// Lists of releases allow Bazelisk to resolve versions like "latest" on machines that cannot reach GitHub.
+	for fork := range forks {
+		listing := filepath.Join(bazeliskHome, fork+releasesListingSuffix)
+		if _, err := os.Stat(listing); err == nil {
+			files = append(files, listing)
+		}
+	}
+	sort.Strings(files)
+
+	if err := writeBundle(bazeliskHome, bundlePath, files); err != nil {
+		return -1, err
+	}
+	fmt.Fprintf(out, "Exported %d binaries to %s\n", len(digests), bundlePath)
+	return 0, nil
+}
+
+func writeBundle(bazeliskHome, bundlePath string, files []string) error {
+	f, err := os.Create(bundlePath)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", bundlePath, err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := addFileToBundle(tw, bazeliskHome, file); err != nil {
+			return fmt.Errorf("could not add %s to %s: %v", file, bundlePath, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", bundlePath, err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("could not write %s: %v", bundlePath, err)
+	}
+	return f.Close()
+}
+
+func addFileToBundle(tw *tar.Writer, bazeliskHome, file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	name, err := filepath.Rel(bazeliskHome, file)
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// importBundle adds the contents of a bundle created by --export_bundle to the Bazelisk home directory.
+// Every binary is verified against its digest, and existing binaries and metadata entries are never overwritten.
+// Lists of releases are only imported if they are valid JSON and newer than the existing ones. Provenance records, which older versions
+// of Bazelisk included in bundles, are skipped since they cannot be verified.
+func importBundle(bazeliskHome, bundlePath string, out io.Writer) (int, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return -1, fmt.Errorf("could not open %s: %v", bundlePath, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return -1, fmt.Errorf("could not read %s: %v", bundlePath, err)
+	}
+	tr := tar.NewReader(gz)
+
+	// Metadata entries are only written after all binaries have been imported, so that they never point to missing binaries.
+	metadata := make(map[string][]byte)
+	imported := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return -1, fmt.Errorf("could not read %s: %v", bundlePath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return -1, fmt.Errorf("%s contains an invalid path %s", bundlePath, header.Name)
+		}
+		parts := strings.Split(name, "/")
+		switch {
+		case len(parts) == 5 && parts[0] == "downloads" && parts[1] == "sha256" && parts[3] == "bin":
+			added, err := importBinary(bazeliskHome, parts[2], parts[4], tr)
+			if err != nil {
+				return -1, fmt.Errorf("could not import %s from %s: %v", name, bundlePath, err)
+			}
+			if added {
+				imported++
+			}
+		case len(parts) >= 4 && parts[0] == "downloads" && parts[1] == "metadata" && strings.HasSuffix(name, provenanceRecordSuffix):
+			fmt.Fprintf(out, "Skipped %s since it cannot be verified\n", name)
+		case len(parts) == 1 && strings.HasSuffix(name, releasesListingSuffix):
+			if err := importListing(bazeliskHome, name, header.ModTime, tr, out); err != nil {
+				return -1, fmt.Errorf("could not import %s from %s: %v", name, bundlePath, err)
+			}
+		case len(parts) >= 4 && parts[0] == "downloads" && parts[1] == "metadata":
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				return -1, fmt.Errorf("could not read %s from %s: %v", name, bundlePath, err)
+			}
+			metadata[name] = contents
+		default:
+			return -1, fmt.Errorf("%s contains an unexpected file %s", bundlePath, header.Name)
+		}
+	}
+
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// All entries are checked before any of them is written, so that a conflicting bundle doesn't leave a partial import behind.
+	var newNames []string
+	for _, name := range names {
+		digest := string(metadata[name])
+		binaries, _ := filepath.Glob(filepath.Join(bazeliskHome, "downloads", "sha256", digest, "bin", "bazel*"))
+		if !sha256Pattern.MatchString(digest) || len(binaries) == 0 {
+			return -1, fmt.Errorf("%s in %s refers to a binary that is not in the bundle", name, bundlePath)
+		}
+		existing, err := os.ReadFile(filepath.Join(bazeliskHome, filepath.FromSlash(name)))
+		if err == nil && string(existing) != digest {
+			return -1, fmt.Errorf("%s in %s refers to sha256=%s, but the existing entry refers to sha256=%s", name, bundlePath, digest, existing)
+		} else if err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return -1, fmt.Errorf("could not read %s: %v", name, err)
+		}
+		newNames = append(newNames, name)
+	}
+	for _, name := range newNames {
+		if err := atomicWriteFile(filepath.Join(bazeliskHome, filepath.FromSlash(name)), metadata[name], 0644); err != nil {
+			return -1, err
+		}
+		fmt.Fprintf(out, "Imported %s\n", strings.TrimPrefix(name, "downloads/metadata/"))
+	}
+
+	fmt.Fprintf(out, "Imported %d new binaries from %s\n", imported, bundlePath)
+	return 0, nil
+}
+
+// importListing stores the list of releases in r, unless it's not valid JSON or the existing list is at least as recent.
+// The list keeps its modification time, so that Bazelisk refreshes it as usual once GitHub can be reached.
+func importListing(bazeliskHome, name string, modTime time.Time, r io.Reader, out io.Writer) error {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var releases []json.RawMessage
+	if err := json.Unmarshal(contents, &releases); err != nil {
+		fmt.Fprintf(out, "Skipped %s since it is not a valid list of releases: %v\n", name, err)
+		return nil
+	}
+
+	listingPath := filepath.Join(bazeliskHome, name)
+	if stat, err := os.Stat(listingPath); err == nil && !stat.ModTime().Before(modTime) {
+		fmt.Fprintf(out, "Kept %s since the existing list is at least as recent\n", name)
+		return nil
+	}
+	if err := atomicWriteFile(listingPath, contents, 0644); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(listingPath, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "Imported %s\n", name)
+	return nil
+}
+
+// importBinary stores the binary in r in the CAS, unless there already is a binary with the given digest.
+func importBinary(bazeliskHome, digest, basename string, r io.Reader) (bool, error) {
+	if !sha256Pattern.MatchString(digest) || !strings.HasPrefix(basename, "bazel") {
+		return false, errors.New("unexpected file name")
+	}
+	pathToBazelInCAS := filepath.Join(bazeliskHome, "downloads", "sha256", digest, "bin", basename)
+	if _, err := os.Stat(pathToBazelInCAS); err == nil {
+		return false, nil
+	}
+
+	dir := filepath.Dir(pathToBazelInCAS)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("failed to MkdirAll %s: %w", dir, err)
+	}
+	tmpFile, err := os.CreateTemp(dir, basename+".tmp")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temporary file in %s: %w", dir, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, h), r)
+	tmpFile.Close()
+	if err != nil {
+		return false, err
+	}
+	if actualSha256 := fmt.Sprintf("%x", h.Sum(nil)); actualSha256 != digest {
+		os.Remove(tmpFile.Name())
+		os.Remove(dir)
+		os.Remove(filepath.Dir(dir))
+		return false, fmt.Errorf("has sha256=%s, which does not match its path", actualSha256)
+	}
+	if err := os.Chmod(tmpFile.Name(), 0755); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFile.Name(), pathToBazelInCAS); err != nil {
+		return false, fmt.Errorf("failed to move %s to %s: %w", tmpFile.Name(), pathToBazelInCAS, err)
+	}
+	markUsed(pathToBazelInCAS)
+	return true, nil
+}
+
+// runBundleCommand runs --export_bundle=<file> or --import_bundle=<file>.
+func runBundleCommand(command string, args []string, bazeliskHome string, out io.Writer) (int, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+	name, bundlePath, _ := strings.Cut(command, "=")
+	if bundlePath == "" {
+		return -1, fmt.Errorf("%s must have a value. Expected format: '%s=<path to .tar.gz file>'", name, name)
+	}
+
+	if name == "--import_bundle" {
+		if len(args) > 0 {
+			return -1, fmt.Errorf("unexpected arguments for --import_bundle: %v", args)
+		}
+		return importBundle(bazeliskHome, bundlePath, out)
+	}
+
+	filter, err := parseBundleFilter(args)
+	if err != nil {
+		return -1, err
+	}
+	return exportBundle(bazeliskHome, bundlePath, filter, out)
+}
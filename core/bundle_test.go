@@ -0,0 +1,195 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportAndImportBundle(t *testing.T) {
+	source := t.TempDir()
+	now := time.Now()
+	linux := addCacheEntry(t, source, "bazel-7.4.1-linux-x86_64", "linux", now)
+	darwin := addCacheEntry(t, source, "bazel-7.4.1-darwin-arm64", "darwin", now)
+	addCacheEntry(t, source, "bazel_nojdk-7.4.1-linux-x86_64", "nojdk", now)
+	addCacheEntry(t, source, "bazel-6.5.0-linux-x86_64", "old", now)
+	os.WriteFile(filepath.Join(source, "bazelbuild-releases.json"), []byte("[]"), 0644)
+
+	filter, err := parseBundleFilter([]string{"--platforms=linux-x86_64,darwin-arm64", "--flavors=bazel", "7.4.1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bazel.tar.gz")
+	if _, err := exportBundle(source, bundle, filter, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	destination := t.TempDir()
+	if _, err := importBundle(destination, bundle, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, err := readCacheEntries(destination)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, entry := range entries {
+		got[entry.digest] = true
+	}
+	if len(got) != 2 || !got[linux] || !got[darwin] {
+		t.Fatalf("Expected only the binaries for 7.4.1 on linux-x86_64 and darwin-arm64 to be imported, but got %v", got)
+	}
+	if digest, err := os.ReadFile(filepath.Join(destination, "downloads", "metadata", "bazelbuild", "bazel-7.4.1-linux-x86_64")); err != nil || string(digest) != linux {
+		t.Fatalf("Expected the metadata to be imported, but got %q (%v)", digest, err)
+	}
+	if listing, err := os.ReadFile(filepath.Join(destination, "bazelbuild-releases.json")); err != nil || string(listing) != "[]" {
+		t.Fatalf("Expected the list of releases to be imported, but got %q (%v)", listing, err)
+	}
+}
+
+func TestImportBundleSkipsUnverifiableFiles(t *testing.T) {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("bazel")))
+	name := "downloads/metadata/bazelbuild/bazel-7.4.1-linux-x86_64"
+	bundle := writeTestBundle(t, map[string]string{
+		"downloads/sha256/" + digest + "/bin/bazel": "bazel",
+		name:                          digest,
+		name + provenanceRecordSuffix: `{"verified": true}`,
+		"some_fork-releases.json":     "<html>",
+	})
+
+	bazeliskHome := t.TempDir()
+	if _, err := importBundle(bazeliskHome, bundle, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(bazeliskHome, filepath.FromSlash(name))); err != nil || string(got) != digest {
+		t.Fatalf("Expected the metadata to be imported, but got %q (%v)", got, err)
+	}
+	for _, skipped := range []string{name + provenanceRecordSuffix, "some_fork-releases.json"} {
+		if _, err := os.Stat(filepath.Join(bazeliskHome, filepath.FromSlash(skipped))); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be skipped", skipped)
+		}
+	}
+}
+
+func TestImportBundleRefusesToReplaceMetadata(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	existing := addCacheEntry(t, bazeliskHome, "bazel-7.4.1-linux-x86_64", "existing", time.Now())
+
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("other")))
+	bundle := writeTestBundle(t, map[string]string{
+		"downloads/sha256/" + digest + "/bin/bazel":                    "other",
+		"downloads/metadata/bazelbuild/bazel-7.4.1-linux-x86_64":       digest,
+		"downloads/metadata/bazelbuild/bazel_nojdk-7.4.1-linux-x86_64": digest,
+	})
+	_, err := importBundle(bazeliskHome, bundle, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "existing entry refers to sha256="+existing) {
+		t.Fatalf("Expected an error about the existing entry, but got %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(bazeliskHome, "downloads", "metadata", "bazelbuild", "bazel-7.4.1-linux-x86_64")); string(got) != existing {
+		t.Errorf("Expected the existing entry to be kept, but it refers to %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "metadata", "bazelbuild", "bazel_nojdk-7.4.1-linux-x86_64")); !os.IsNotExist(err) {
+		t.Errorf("Expected no metadata to be imported from a conflicting bundle")
+	}
+
+	// Importing an entry that already refers to the same binary is fine.
+	bundle = writeTestBundle(t, map[string]string{
+		"downloads/sha256/" + existing + "/bin/bazel":            "existing",
+		"downloads/metadata/bazelbuild/bazel-7.4.1-linux-x86_64": existing,
+	})
+	if _, err := importBundle(bazeliskHome, bundle, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// writeTestBundle creates a bundle with the given files, without any of the checks that --export_bundle does.
+func TestImportBundleKeepsNewerListing(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	listingPath := filepath.Join(bazeliskHome, "bazelbuild-releases.json")
+	os.WriteFile(listingPath, []byte(`["newer"]`), 0644)
+
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("bazel")))
+	bundle := writeTestBundle(t, map[string]string{
+		"downloads/sha256/" + digest + "/bin/bazel": "bazel",
+		"bazelbuild-releases.json":                  `["older"]`,
+		"some_fork-releases.json":                   `["new"]`,
+	})
+	if _, err := importBundle(bazeliskHome, bundle, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got, _ := os.ReadFile(listingPath); string(got) != `["newer"]` {
+		t.Errorf("Expected the newer list of releases to be kept, but got %s", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(bazeliskHome, "some_fork-releases.json")); string(got) != `["new"]` {
+		t.Errorf("Expected the list of releases to be imported, but got %q", got)
+	}
+}
+
+func writeTestBundle(t *testing.T, files map[string]string) string {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(contents))
+	}
+	tw.Close()
+	gz.Close()
+
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportBundleRejectsInvalidContents(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:    "TamperedBinary",
+			files:   map[string]string{"downloads/sha256/" + digest + "/bin/bazel": "tampered"},
+			wantErr: "does not match its path",
+		},
+		{
+			name:    "PathTraversal",
+			files:   map[string]string{"../../.bashrc": "evil"},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "UnexpectedFile",
+			files:   map[string]string{"downloads/_tmp/evil": "evil"},
+			wantErr: "unexpected file",
+		},
+		{
+			name:    "DanglingMetadata",
+			files:   map[string]string{"downloads/metadata/bazelbuild/bazel-7.4.1-linux-x86_64": digest},
+			wantErr: "not in the bundle",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bazeliskHome := t.TempDir()
+			_, err := importBundle(bazeliskHome, writeTestBundle(t, test.files), &bytes.Buffer{})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected error containing %q, but got %v", test.wantErr, err)
+			}
+			if entries, _ := readCacheEntries(bazeliskHome); len(entries) != 0 {
+				t.Fatalf("Expected nothing to be imported")
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+const (
+	// CacheMaxSizeEnv is the name of the environment variable that stores the maximum size of the downloaded binaries,
+	// e.g. "5G". Bazelisk evicts the least recently used binaries after every download that exceeds it.
+	CacheMaxSizeEnv = "BAZELISK_CACHE_MAX_SIZE"
+
+	lastUsedFile = "last_used"
+
+	// tmpFileMaxAge is how long a file in downloads/_tmp may go without being modified before it's considered orphaned.
+	tmpFileMaxAge = 24 * time.Hour
+
+	// quarantineMaxAge is how long a file that failed validation is kept in downloads/_quarantine for inspection.
+	quarantineMaxAge = 7 * 24 * time.Hour
+)
+
+// cacheEntry describes a Bazel binary in the CAS under downloads/sha256, along with the metadata entries that refer to it.
+type cacheEntry struct {
+	digest   string
+	dir      string
+	binary   string
+	size     int64
+	lastUsed time.Time
+	// names contains the paths of the metadata entries (relative to downloads/metadata) that refer to this binary, e.g. "bazelbuild/bazel-7.4.1-linux-x86_64".
+	names []string
+}
+
+// pruneOptions controls which cache entries --cache_prune removes. Zero values disable the respective criterion.
+type pruneOptions struct {
+	olderThan  time.Duration
+	keepLatest int
+	maxSize    int64
+	dryRun     bool
+	// keepDigest is the digest of a binary that must not be removed.
+	keepDigest string
+}
+
+// markUsed records that the given Bazel binary in the CAS was just used, which determines the order in which --cache_prune removes binaries.
+func markUsed(pathToBazelInCAS string) {
+	path := filepath.Join(filepath.Dir(filepath.Dir(pathToBazelInCAS)), lastUsedFile)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); os.IsNotExist(err) {
+		os.WriteFile(path, nil, 0644)
+	}
+}
+
+// isMetadataEntry returns whether the file with the given name in downloads/metadata maps a Bazel version to a digest,
+// as opposed to files with additional information or temporary files.
+func isMetadataEntry(name string) bool {
+	return !strings.HasSuffix(name, provenanceRecordSuffix) && !strings.Contains(name, ".tmp")
+}
+
+// readCacheEntries returns all binaries in the CAS of the given Bazelisk home directory, most recently used first.
+func readCacheEntries(bazeliskHome string) ([]*cacheEntry, error) {
+	casDir := filepath.Join(bazeliskHome, "downloads", "sha256")
+	dirs, err := os.ReadDir(casDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", casDir, err)
+	}
+
+	entries := make(map[string]*cacheEntry)
+	var result []*cacheEntry
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entry := &cacheEntry{digest: dir.Name(), dir: filepath.Join(casDir, dir.Name())}
+		// Entries that are still being created have neither a binary nor a last_used file yet.
+		if info, err := dir.Info(); err == nil {
+			entry.lastUsed = info.ModTime()
+		}
+		binaries, _ := filepath.Glob(filepath.Join(entry.dir, "bin", "bazel*"))
+		for _, binary := range binaries {
+			if stat, err := os.Stat(binary); err == nil && !strings.Contains(filepath.Base(binary), ".tmp") {
+				entry.binary = binary
+				entry.size = stat.Size()
+				entry.lastUsed = stat.ModTime()
+			}
+		}
+		if stat, err := os.Stat(filepath.Join(entry.dir, lastUsedFile)); err == nil {
+			entry.lastUsed = stat.ModTime()
+		}
+		entries[entry.digest] = entry
+		result = append(result, entry)
+	}
+
+	metadataDir := filepath.Join(bazeliskHome, "downloads", "metadata")
+	err = filepath.WalkDir(metadataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isMetadataEntry(d.Name()) {
+			return nil
+		}
+		digest, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if entry, ok := entries[string(digest)]; ok {
+			name, _ := filepath.Rel(metadataDir, path)
+			entry.names = append(entry.names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", metadataDir, err)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].lastUsed.After(result[j].lastUsed)
+	})
+	return result, nil
+}
+
+// removeCacheEntry removes a binary from the CAS along with all metadata entries that refer to it.
+// It returns false without removing anything if another process is currently downloading one of the entries,
+// or if the binary is unreferenced and so recent that another process may be about to write its metadata entry.
+func removeCacheEntry(bazeliskHome string, entry *cacheEntry) (bool, error) {
+	// moveIntoCAS marks a binary as used right before the metadata entry is written, so twice the time after which a lock is
+	// considered stale is a generous upper bound for the time in which a new binary is unreferenced.
+	if len(entry.names) == 0 && time.Since(entry.lastUsed) < 2*lockStaleAfter {
+		return false, nil
+	}
+
+	// Holding the download locks of all metadata entries ensures that no other process is downloading the binary
+	// or pointing one of the entries at it while it's being removed.
+	for _, name := range entry.names {
+		lock, err := tryAcquireLock(downloadLockPath(bazeliskHome, path.Dir(name), path.Base(name)))
+		if err != nil {
+			return false, err
+		} else if lock == nil {
+			return false, nil
+		}
+		defer lock.release()
+	}
+
+	metadataDir := filepath.Join(bazeliskHome, "downloads", "metadata")
+	for _, name := range entry.names {
+		mappingPath := filepath.Join(metadataDir, filepath.FromSlash(name))
+		if err := os.Remove(mappingPath); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("could not remove %s: %v", mappingPath, err)
+		}
+		os.Remove(mappingPath + provenanceRecordSuffix)
+	}
+	if err := os.RemoveAll(entry.dir); err != nil {
+		return false, fmt.Errorf("could not remove %s: %v", entry.dir, err)
+	}
+	return true, nil
+}
+
+// listCache implements --cache_list.
+func listCache(bazeliskHome string, out io.Writer) (int, error) {
+	entries, err := readCacheEntries(bazeliskHome)
+	if err != nil {
+		return -1, err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SHA256\tSIZE\tLAST USED\tVERSIONS")
+	var total int64
+	for _, entry := range entries {
+		names := strings.Join(entry.names, ", ")
+		if names == "" {
+			names = "(unreferenced)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.digest, formatSize(entry.size), entry.lastUsed.Format("2006-01-02 15:04"), names)
+		total += entry.size
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d binaries, %s in total\n", len(entries), formatSize(total))
+	return 0, nil
+}
+
+// pruneCache implements --cache_prune. Binaries are removed in least-recently-used order.
+func pruneCache(bazeliskHome string, options pruneOptions, out io.Writer) (int, error) {
+	freed, err := pruneCacheEntries(bazeliskHome, options, out)
+	if err != nil {
+		return -1, err
+	}
+
+	action := "Removed"
+	if options.dryRun {
+		action = "Would remove"
+	}
+
+	cleanupPaths, err := findOrphanedFiles(bazeliskHome)
+	if err != nil {
+		return -1, err
+	}
+	for _, path := range cleanupPaths {
+		if !options.dryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return -1, fmt.Errorf("could not remove %s: %v", path, err)
+			}
+		}
+		fmt.Fprintf(out, "%s %s\n", action, path)
+	}
+
+	fmt.Fprintf(out, "%s %s\n", action, formatSize(freed))
+	return 0, nil
+}
+
+// pruneCacheEntries removes the binaries in the CAS that match the given options, and returns the number of bytes that were freed.
+func pruneCacheEntries(bazeliskHome string, options pruneOptions, out io.Writer) (int64, error) {
+	entries, err := readCacheEntries(bazeliskHome)
+	if err != nil {
+		return 0, err
+	}
+
+	action := "Removed"
+	if options.dryRun {
+		action = "Would remove"
+	}
+
+	// The binary that must be kept counts towards the size limit first, regardless of when it was used.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].digest == options.keepDigest && entries[j].digest != options.keepDigest
+	})
+
+	var kept, freed int64
+	for i, entry := range entries {
+		if entry.digest == options.keepDigest {
+			kept += entry.size
+			continue
+		}
+
+		reason := ""
+		if options.olderThan > 0 && time.Since(entry.lastUsed) > options.olderThan {
+			reason = "not used since " + entry.lastUsed.Format("2006-01-02")
+		} else if options.keepLatest > 0 && i >= options.keepLatest {
+			reason = fmt.Sprintf("not among the %d most recently used binaries", options.keepLatest)
+		} else if options.maxSize > 0 && kept+entry.size > options.maxSize {
+			reason = fmt.Sprintf("cache would exceed %s", formatSize(options.maxSize))
+		}
+
+		if reason == "" {
+			kept += entry.size
+			continue
+		}
+		if !options.dryRun {
+			if removed, err := removeCacheEntry(bazeliskHome, entry); err != nil {
+				return freed, err
+			} else if !removed {
+				fmt.Fprintf(out, "Skipped %s (%s): in use by another Bazelisk process\n", entry.digest, strings.Join(entry.names, ", "))
+				kept += entry.size
+				continue
+			}
+		}
+		freed += entry.size
+		fmt.Fprintf(out, "%s %s (%s): %s\n", action, entry.digest, strings.Join(entry.names, ", "), reason)
+	}
+	return freed, nil
+}
+
+// enforceCacheSizeLimit evicts the least recently used binaries from the CAS until it's no larger than BAZELISK_CACHE_MAX_SIZE.
+// The binary with the given digest is never evicted.
+func enforceCacheSizeLimit(bazeliskHome, currentDigest string, config config.Config) error {
+	value := config.Get(CacheMaxSizeEnv)
+	if value == "" {
+		return nil
+	}
+	maxSize, err := parseSize(value)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %v", value, CacheMaxSizeEnv, err)
+	}
+
+	_, err = pruneCacheEntries(bazeliskHome, pruneOptions{maxSize: maxSize, keepDigest: currentDigest}, log.Writer())
+	return err
+}
+
+// findOrphanedFiles returns leftovers of interrupted downloads, old quarantined files, stale locks and links to local Bazel binaries
+// that no longer exist.
+// Partial downloads are kept regardless of their age, since the next download of the same URL resumes them.
+func findOrphanedFiles(bazeliskHome string) ([]string, error) {
+	var paths []string
+
+	tmpDir := filepath.Join(bazeliskHome, "downloads", "_tmp")
+	tmpFiles, err := os.ReadDir(tmpDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", tmpDir, err)
+	}
+	for _, f := range tmpFiles {
+		if httputil.IsPartialDownload(f.Name()) {
+			continue
+		}
+		if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > tmpFileMaxAge {
+			paths = append(paths, filepath.Join(tmpDir, f.Name()))
+		}
+	}
+
+	quarantineDir := filepath.Join(bazeliskHome, "downloads", "_quarantine")
+	quarantinedFiles, err := os.ReadDir(quarantineDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", quarantineDir, err)
+	}
+	for _, f := range quarantinedFiles {
+		if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > quarantineMaxAge {
+			paths = append(paths, filepath.Join(quarantineDir, f.Name()))
+		}
+	}
+
+	locksDir := filepath.Join(bazeliskHome, "downloads", "_locks")
+	locks, err := os.ReadDir(locksDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", locksDir, err)
+	}
+	for _, f := range locks {
+		if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			paths = append(paths, filepath.Join(locksDir, f.Name()))
+		}
+	}
+
+	// linkLocalBazel creates local/[path]/bin/bazel[extension] for every local Bazel binary.
+	localDir := filepath.Join(bazeliskHome, "local")
+	links, err := os.ReadDir(localDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", localDir, err)
+	}
+	for _, link := range links {
+		binaries, _ := filepath.Glob(filepath.Join(localDir, link.Name(), "bin", "bazel*"))
+		dangling := len(binaries) == 0
+		for _, binary := range binaries {
+			if _, err := os.Stat(binary); err != nil {
+				dangling = true
+			}
+		}
+		if dangling {
+			paths = append(paths, filepath.Join(localDir, link.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// verifyCache implements --cache_verify. Binaries whose contents don't match their digest are removed, so that they are downloaded again.
+func verifyCache(bazeliskHome string, out io.Writer) (int, error) {
+	entries, err := readCacheEntries(bazeliskHome)
+	if err != nil {
+		return -1, err
+	}
+
+	corrupted := 0
+	for _, entry := range entries {
+		problem := ""
+		if entry.binary == "" {
+			problem = "no binary"
+		} else if actualSha256, err := sha256OfFile(entry.binary); err != nil {
+			problem = err.Error()
+		} else if actualSha256 != entry.digest {
+			problem = "actual sha256=" + actualSha256
+		}
+
+		if problem == "" {
+			continue
+		}
+		corrupted++
+		fmt.Fprintf(out, "Removing corrupted %s (%s): %s\n", entry.digest, strings.Join(entry.names, ", "), problem)
+		if removed, err := removeCacheEntry(bazeliskHome, entry); err != nil {
+			return -1, err
+		} else if !removed {
+			fmt.Fprintf(out, "Could not remove %s: in use by another Bazelisk process\n", entry.digest)
+		}
+	}
+
+	fmt.Fprintf(out, "Verified %d binaries, %d of them were corrupted\n", len(entries), corrupted)
+	if corrupted > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func sha256OfFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot compute sha256 of %s: %v", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// parsePruneOptions parses the arguments of --cache_prune, e.g. "--older_than=30d", "--keep_latest=3", "--max_size=2G" and "--dry_run".
+func parsePruneOptions(args []string) (pruneOptions, error) {
+	var options pruneOptions
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, "=")
+		var err error
+		switch name {
+		case "--older_than":
+			options.olderThan, err = parseAge(value)
+		case "--keep_latest":
+			options.keepLatest, err = strconv.Atoi(value)
+			if err == nil && options.keepLatest < 1 {
+				err = errors.New("must be a positive number")
+			}
+		case "--max_size":
+			options.maxSize, err = parseSize(value)
+		case "--dry_run":
+			options.dryRun = true
+		default:
+			return options, fmt.Errorf("unknown option %q for --cache_prune, expected --older_than=<age>, --keep_latest=<n>, --max_size=<size> or --dry_run", arg)
+		}
+		if err != nil {
+			return options, fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+	}
+	return options, nil
+}
+
+// parseAge parses a duration like time.ParseDuration, but also accepts a number of days such as "30d".
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix (powers of 1024).
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.TrimSuffix(strings.ToUpper(value), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(upper, suffix); ok {
+			multiplier = int64(1) << (10 * (i + 1))
+			upper = n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("expected a number of bytes, optionally followed by K, M, G or T")
+	}
+	return n * multiplier, nil
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGT"[exp])
+}
+
+// runCacheCommand runs one of the --cache_* commands, which manage the downloaded binaries in the Bazelisk home directory.
+// Shared caches are never modified.
+func runCacheCommand(command string, args []string, bazeliskHome string, out io.Writer) (int, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+	switch command {
+	case "--cache_list":
+		return listCache(bazeliskHome, out)
+	case "--cache_prune":
+		options, err := parsePruneOptions(args)
+		if err != nil {
+			return -1, err
+		}
+		return pruneCache(bazeliskHome, options, out)
+	case "--cache_verify":
+		return verifyCache(bazeliskHome, out)
+	}
+	return -1, fmt.Errorf("unknown cache command %s", command)
+}
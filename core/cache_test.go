@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+// addCacheEntry stores a fake Bazel binary in the CAS, along with a metadata entry that refers to it.
+func addCacheEntry(t *testing.T, bazeliskHome, name, contents string, lastUsed time.Time) string {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(contents)))
+	binary := filepath.Join(bazeliskHome, "downloads", "sha256", digest, "bin", "bazel")
+	if err := os.MkdirAll(filepath.Dir(binary), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(binary, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+	markUsed(binary)
+	if err := os.Chtimes(filepath.Join(filepath.Dir(filepath.Dir(binary)), lastUsedFile), lastUsed, lastUsed); err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicWriteFile(filepath.Join(bazeliskHome, "downloads", "metadata", "bazelbuild", name), []byte(digest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestListCache(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	now := time.Now()
+	oldDigest := addCacheEntry(t, bazeliskHome, "bazel-6.5.0-linux-x86_64", "old", now.Add(-time.Hour))
+	newDigest := addCacheEntry(t, bazeliskHome, "bazel-7.4.1-linux-x86_64", "new", now)
+
+	var out bytes.Buffer
+	if _, err := listCache(bazeliskHome, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[1], newDigest) || !strings.HasPrefix(lines[2], oldDigest) {
+		t.Fatalf("Expected the most recently used binary first, but got:\n%s", out.String())
+	}
+	if !strings.Contains(lines[1], "bazelbuild/bazel-7.4.1-linux-x86_64") {
+		t.Fatalf("Expected the versions of the binaries to be listed, but got:\n%s", out.String())
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		options pruneOptions
+		want    []string
+	}{
+		{name: "OlderThan", options: pruneOptions{olderThan: 48 * time.Hour}, want: []string{"a", "b"}},
+		{name: "KeepLatest", options: pruneOptions{keepLatest: 1}, want: []string{"a"}},
+		{name: "MaxSize", options: pruneOptions{maxSize: 5}, want: []string{"a", "b"}},
+		{name: "DryRun", options: pruneOptions{keepLatest: 1, dryRun: true}, want: []string{"a", "b", "c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bazeliskHome := t.TempDir()
+			digests := map[string]string{
+				"a": addCacheEntry(t, bazeliskHome, "bazel-a", "aaa", now),
+				"b": addCacheEntry(t, bazeliskHome, "bazel-b", "bb", now.Add(-24*time.Hour)),
+				"c": addCacheEntry(t, bazeliskHome, "bazel-c", "c", now.Add(-72*time.Hour)),
+			}
+
+			var out bytes.Buffer
+			if _, err := pruneCache(bazeliskHome, test.options, &out); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			entries, err := readCacheEntries(bazeliskHome)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				for name, digest := range digests {
+					if entry.digest == digest {
+						got = append(got, name)
+					}
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Fatalf("Expected %v to be kept, but got %v:\n%s", test.want, got, out.String())
+			}
+
+			metadata, _ := filepath.Glob(filepath.Join(bazeliskHome, "downloads", "metadata", "bazelbuild", "*"))
+			if !test.options.dryRun && len(metadata) != len(test.want) {
+				t.Fatalf("Expected the metadata of removed binaries to be removed, too, but got %v", metadata)
+			}
+		})
+	}
+}
+
+func TestPruneCacheRemovesOrphanedFiles(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	old := time.Now().Add(-2 * tmpFileMaxAge)
+
+	tmpDir := filepath.Join(bazeliskHome, "downloads", "_tmp")
+	os.MkdirAll(tmpDir, 0755)
+	oldTmpFile := filepath.Join(tmpDir, "0123abcd")
+	newTmpFile := filepath.Join(tmpDir, "4567ef01")
+	partialDownload := filepath.Join(tmpDir, "partial-89ab")
+	os.WriteFile(oldTmpFile, []byte("old"), 0644)
+	os.WriteFile(newTmpFile, []byte("new"), 0644)
+	os.WriteFile(partialDownload, []byte("partial"), 0644)
+	os.WriteFile(partialDownload+".validator", []byte(`"etag"`), 0644)
+	for _, path := range []string{oldTmpFile, partialDownload, partialDownload + ".validator"} {
+		os.Chtimes(path, old, old)
+	}
+
+	quarantineDir := filepath.Join(bazeliskHome, "downloads", "_quarantine")
+	os.MkdirAll(quarantineDir, 0755)
+	oldQuarantinedFile := filepath.Join(quarantineDir, "20240101T000000Z-0123abcd")
+	newQuarantinedFile := filepath.Join(quarantineDir, "20240102T000000Z-4567ef01")
+	os.WriteFile(oldQuarantinedFile, []byte("old"), 0644)
+	os.WriteFile(newQuarantinedFile, []byte("new"), 0644)
+	veryOld := time.Now().Add(-2 * quarantineMaxAge)
+	os.Chtimes(oldQuarantinedFile, veryOld, veryOld)
+
+	localBazel := filepath.Join(t.TempDir(), "bazel")
+	os.WriteFile(localBazel, []byte("local"), 0755)
+	link, err := linkLocalBazel(filepath.Join(bazeliskHome, "local"), localBazel)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	os.Remove(localBazel)
+
+	if _, err := pruneCache(bazeliskHome, pruneOptions{}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(oldTmpFile); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", oldTmpFile)
+	}
+	if _, err := os.Stat(newTmpFile); err != nil {
+		t.Errorf("Expected %s to be kept since it may still be in use", newTmpFile)
+	}
+	for _, path := range []string{partialDownload, partialDownload + ".validator"} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to be kept so that the download can be resumed", path)
+		}
+	}
+	if _, err := os.Stat(oldQuarantinedFile); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", oldQuarantinedFile)
+	}
+	if _, err := os.Stat(newQuarantinedFile); err != nil {
+		t.Errorf("Expected %s to be kept for inspection", newQuarantinedFile)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Errorf("Expected the dangling link %s to be removed", link)
+	}
+}
+
+func TestPruneCacheSkipsBinariesThatWereJustAddedByOtherProcesses(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	now := time.Now()
+	// Another process has moved this binary into the CAS, but not written its metadata entry yet.
+	recent := addCacheEntry(t, bazeliskHome, "bazel-a", "recent", now)
+	old := addCacheEntry(t, bazeliskHome, "bazel-b", "old", now.Add(-72*time.Hour))
+	os.RemoveAll(filepath.Join(bazeliskHome, "downloads", "metadata"))
+
+	if _, err := pruneCache(bazeliskHome, pruneOptions{keepLatest: 1}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := pruneCache(bazeliskHome, pruneOptions{maxSize: 1}, &bytes.Buffer{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", recent)); err != nil {
+		t.Errorf("Expected the recently added binary to be kept")
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", old)); !os.IsNotExist(err) {
+		t.Errorf("Expected the old unreferenced binary to be removed")
+	}
+}
+
+func TestPruneCacheSkipsBinariesThatAreBeingDownloaded(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	digest := addCacheEntry(t, bazeliskHome, "bazel-a", "aaa", time.Now().Add(-72*time.Hour))
+
+	lock, err := acquireLock(context.Background(), downloadLockPath(bazeliskHome, "bazelbuild", "bazel-a"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var out bytes.Buffer
+	if _, err := pruneCache(bazeliskHome, pruneOptions{olderThan: 48 * time.Hour}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", digest)); err != nil {
+		t.Fatalf("Expected the binary to be kept while its download lock is held:\n%s", out.String())
+	}
+
+	lock.release()
+	out.Reset()
+	if _, err := pruneCache(bazeliskHome, pruneOptions{olderThan: 48 * time.Hour}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", digest)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the binary to be removed after the lock was released:\n%s", out.String())
+	}
+	if locks, _ := os.ReadDir(filepath.Join(bazeliskHome, "downloads", "_locks")); len(locks) != 0 {
+		t.Errorf("Expected all locks to be released, but got %v", locks)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	now := time.Now()
+	goodDigest := addCacheEntry(t, bazeliskHome, "bazel-good", "good", now)
+	badDigest := addCacheEntry(t, bazeliskHome, "bazel-bad", "bad", now)
+	os.WriteFile(filepath.Join(bazeliskHome, "downloads", "sha256", badDigest, "bin", "bazel"), []byte("corrupted"), 0755)
+
+	var out bytes.Buffer
+	exitCode, err := verifyCache(bazeliskHome, &out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if exitCode != 1 || !strings.Contains(out.String(), "Removing corrupted "+badDigest) {
+		t.Fatalf("Expected the corrupted binary to be reported, but got exit code %d:\n%s", exitCode, out.String())
+	}
+
+	entries, _ := readCacheEntries(bazeliskHome)
+	if len(entries) != 1 || entries[0].digest != goodDigest {
+		t.Fatalf("Expected only the intact binary to remain")
+	}
+}
+
+func TestParsePruneOptions(t *testing.T) {
+	options, err := parsePruneOptions([]string{"--older_than=30d", "--keep_latest=3", "--max_size=2G", "--dry_run"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := pruneOptions{olderThan: 30 * 24 * time.Hour, keepLatest: 3, maxSize: 2 << 30, dryRun: true}
+	if options != want {
+		t.Fatalf("Expected %+v, but got %+v", want, options)
+	}
+
+	if _, err := parsePruneOptions([]string{"--max_size=lots"}); err == nil {
+		t.Fatalf("Expected an error for an invalid size")
+	}
+}
+
+func TestDownloadEnforcesCacheSizeLimit(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	now := time.Now()
+	// The fake binary that is downloaded below is smaller than each of these.
+	recent := addCacheEntry(t, bazeliskHome, "bazel-recent", strings.Repeat("r", 60), now.Add(-time.Hour))
+	addCacheEntry(t, bazeliskHome, "bazel-old", strings.Repeat("o", 60), now.Add(-24*time.Hour))
+
+	binary := fakeBazelScript("new")
+	path, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:      serveFakeBazel(t, binary, nil),
+		CacheMaxSizeEnv: fmt.Sprint(len(binary) + 60),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, _ := readCacheEntries(bazeliskHome)
+	var digests []string
+	for _, entry := range entries {
+		digests = append(digests, entry.digest)
+	}
+	want := []string{digestFromCASPath(path), recent}
+	if strings.Join(digests, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected the least recently used binary to be evicted, leaving %v, but got %v", want, digests)
+	}
+}
+
+func TestCacheSizeLimitNeverEvictsCurrentBinary(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	current := addCacheEntry(t, bazeliskHome, "bazel-current", "current", time.Now().Add(-time.Hour))
+	addCacheEntry(t, bazeliskHome, "bazel-other", "other", time.Now())
+
+	err := enforceCacheSizeLimit(bazeliskHome, current, config.Static(map[string]string{CacheMaxSizeEnv: "1"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	entries, _ := readCacheEntries(bazeliskHome)
+	if len(entries) != 1 || entries[0].digest != current {
+		t.Fatalf("Expected only the current binary to be kept")
+	}
+}
@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/bazelbuild/bazelisk/versions"
+	"github.com/bazelbuild/bazelisk/ws"
+)
+
+const (
+	// ChecksumsFileEnv is the name of the environment variable that stores the path of a file with the expected sha256 digests of Bazel binaries.
+	// Relative paths are resolved against the workspace root.
+	ChecksumsFileEnv = "BAZELISK_CHECKSUMS_FILE"
+)
+
+// getChecksumsFilePath returns the absolute path of the configured checksums file, or an empty string if there is none.
+func getChecksumsFilePath(config config.Config) (string, error) {
+	path := config.Get(ChecksumsFileEnv)
+	if path == "" || filepath.IsAbs(path) {
+		return path, nil
+	}
+
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("could not get working directory: %v", err)
+	}
+	if workspaceRoot := ws.FindWorkspaceRoot(workingDirectory); workspaceRoot != "" {
+		return filepath.Join(workspaceRoot, path), nil
+	}
+	return filepath.Join(workingDirectory, path), nil
+}
+
+// checksumKey returns the name under which the digest of a binary from the given fork is stored in the checksums file,
+// e.g. "bazelbuild/bazel-7.4.1-linux-x86_64". Different forks may publish different binaries with the same file name.
+func checksumKey(bazelFork, bazelFilename string) string {
+	return bazelFork + "/" + bazelFilename
+}
+
+// readChecksums parses a checksums file, which has the same format as the output of `sha256sum`: one "<digest>  <fork>/<filename>" pair per line.
+// The file names are the ones returned by platforms.DetermineBazelFilename, e.g. "bazel-7.4.1-linux-x86_64".
+// Names without a fork refer to upstream Bazel. A missing file is treated like an empty one.
+func readChecksums(path string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checksums, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read checksums file %s: %v", path, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		digest := strings.ToLower(fields[0])
+		if len(fields) != 2 || !sha256Pattern.MatchString(digest) {
+			return nil, fmt.Errorf("%s:%d: expected '<sha256>  <filename>', but got %q", path, lineNumber, line)
+		}
+		// `sha256sum` marks files that were read in binary mode with a leading '*'.
+		name := strings.TrimSuffix(strings.TrimPrefix(fields[1], "*"), ".exe")
+		if !strings.Contains(name, "/") {
+			name = checksumKey(versions.BazelUpstream, name)
+		}
+		checksums[name] = digest
+	}
+	return checksums, nil
+}
+
+func writeChecksums(path string, checksums map[string]string) error {
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", checksums[name], name)
+	}
+	return atomicWriteFile(path, []byte(b.String()), 0644)
+}
+
+// getExpectedSha256 returns the sha256 digest that the Bazel binary with the given file name from the given fork must have, or an empty string if it's unknown.
+// An explicit BAZELISK_VERIFY_SHA256 value takes precedence over the checksums file, but only pins the binary for the current platform.
+func getExpectedSha256(bazelFork, bazelFilename string, platform platforms.Platform, config config.Config) (string, error) {
+	if expectedSha256 := strings.ToLower(config.Get("BAZELISK_VERIFY_SHA256")); len(expectedSha256) > 0 {
+		currentPlatform, err := platforms.CurrentPlatform()
+		if err != nil {
+			return "", err
+		}
+		if platform == currentPlatform {
+			return expectedSha256, nil
+		}
+	}
+
+	path, err := getChecksumsFilePath(config)
+	if err != nil || path == "" {
+		return "", err
+	}
+	checksums, err := readChecksums(path)
+	if err != nil {
+		return "", err
+	}
+	key := checksumKey(bazelFork, bazelFilename)
+	expectedSha256, ok := checksums[key]
+	if !ok {
+		log.Printf("Warning: %s has no checksum for %s", path, key)
+	}
+	return expectedSha256, nil
+}
+
+// updateChecksums downloads the given Bazel versions (or the version of the current workspace) for the given platforms
+// (or the current one) and records their digests in the checksums file.
+func updateChecksums(ctx context.Context, args []string, bazeliskHome string, repos *Repositories, config config.Config, out io.Writer) (int, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+	path, err := getChecksumsFilePath(config)
+	if err != nil {
+		return -1, err
+	} else if path == "" {
+		return -1, fmt.Errorf("%s must be set to update the checksums file", ChecksumsFileEnv)
+	}
+
+	bazelVersions, targetPlatforms, err := parseVersionsAndPlatforms("--update_checksums", args, config)
+	if err != nil {
+		return -1, err
+	}
+
+	checksums, err := readChecksums(path)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, bazelVersionString := range bazelVersions {
+		resolvedBazelVersion, bazelPaths, err := downloadBazelForPlatforms(ctx, bazelVersionString, targetPlatforms, bazeliskHome, repos, config)
+		if err != nil {
+			return -1, err
+		}
+		// downloadBazelForPlatforms has already validated the version string.
+		bazelFork, _, _ := parseBazelForkAndVersion(bazelVersionString)
+		for i, platform := range targetPlatforms {
+			bazelFilename, err := platforms.DetermineBazelFilenameForPlatform(resolvedBazelVersion, platform, false, config)
+			if err != nil {
+				return -1, err
+			}
+
+			digest := digestFromCASPath(bazelPaths[i])
+			key := checksumKey(bazelFork, bazelFilename)
+			checksums[key] = digest
+			fmt.Fprintf(out, "%s  %s\n", digest, key)
+		}
+	}
+
+	if err := writeChecksums(path, checksums); err != nil {
+		return -1, fmt.Errorf("could not write checksums file %s: %v", path, err)
+	}
+	return 0, nil
+}
+
+// digestFromCASPath returns the sha256 digest of a Bazel binary at downloads/sha256/[sha256]/bin/bazel[extension].
+func digestFromCASPath(pathToBazelInCAS string) string {
+	return filepath.Base(filepath.Dir(filepath.Dir(pathToBazelInCAS)))
+}
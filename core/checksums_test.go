@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+func TestReadChecksums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checksums.txt")
+	contents := "# Pinned Bazel binaries\n" +
+		strings.Repeat("a", 64) + "  bazel-7.4.1-linux-x86_64\n" +
+		"\n" +
+		strings.Repeat("B", 64) + " *bazel-7.4.1-windows-x86_64.exe\n" +
+		strings.Repeat("c", 64) + "  otherfork/bazel-7.4.1-linux-x86_64\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	checksums, err := readChecksums(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"bazelbuild/bazel-7.4.1-linux-x86_64":   strings.Repeat("a", 64),
+		"bazelbuild/bazel-7.4.1-windows-x86_64": strings.Repeat("b", 64),
+		"otherfork/bazel-7.4.1-linux-x86_64":    strings.Repeat("c", 64),
+	}
+	if len(checksums) != len(want) {
+		t.Fatalf("Expected %v, but got %v", want, checksums)
+	}
+	for name, digest := range want {
+		if checksums[name] != digest {
+			t.Errorf("Expected %s to have digest %s, but got %q", name, digest, checksums[name])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("not-a-digest bazel-7.4.1-linux-x86_64\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readChecksums(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Fatalf("Expected a parse error for line 1, but got %v", err)
+	}
+}
+
+func writeFakeBazelChecksum(t *testing.T, digest string) string {
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, false, config.Null())
+	if err != nil {
+		t.Fatalf("Could not determine Bazel filename: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "checksums.txt")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%s  %s\n", digest, filename)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDownloadVerifiesChecksumsFile(t *testing.T) {
+	binary := fakeBazelScript("pinned bazel")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	baseURL := serveFakeBazel(t, binary, nil)
+
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:       baseURL,
+		ChecksumsFileEnv: writeFakeBazelChecksum(t, digest),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	wrongDigest := strings.Repeat("0", 64)
+	_, err = downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:       baseURL,
+		ChecksumsFileEnv: writeFakeBazelChecksum(t, wrongDigest),
+	})
+	if err == nil || !strings.Contains(err.Error(), "need sha256="+wrongDigest) {
+		t.Fatalf("Expected checksum mismatch error, but got %v", err)
+	}
+}
+
+func TestDownloadIgnoresCachedBinaryWithUnexpectedChecksum(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	if _, err := downloadFakeBazel(t, bazeliskHome, map[string]string{BaseURLEnv: serveFakeBazel(t, fakeBazelScript("old bazel"), nil)}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	binary := fakeBazelScript("new bazel")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	path, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:       serveFakeBazel(t, binary, nil),
+		ChecksumsFileEnv: writeFakeBazelChecksum(t, digest),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if digestFromCASPath(path) != digest {
+		t.Fatalf("Expected the pinned binary with digest %s, but got %s", digest, path)
+	}
+}
+
+func TestUpdateChecksums(t *testing.T) {
+	binary := fakeBazelScript("bazel to pin")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	path := filepath.Join(t.TempDir(), "checksums.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("c", 64)+"  bazel-6.5.0-linux-x86_64\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := config.Static(map[string]string{
+		BaseURLEnv:       serveFakeBazel(t, binary, nil),
+		ChecksumsFileEnv: path,
+	})
+	repos := CreateRepositories(nil, nil, nil, nil, true)
+	var out bytes.Buffer
+	if _, err := updateChecksums(context.Background(), []string{fakeBazelVersion}, t.TempDir(), repos, config, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checksums, err := readChecksums(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	filename, _ := platforms.DetermineBazelFilename(fakeBazelVersion, false, config)
+	key := checksumKey(versions.BazelUpstream, filename)
+	if checksums[key] != digest {
+		t.Errorf("Expected %s to be pinned to %s, but got %q", key, digest, checksums[key])
+	}
+	if checksums["bazelbuild/bazel-6.5.0-linux-x86_64"] != strings.Repeat("c", 64) {
+		t.Errorf("Expected existing checksums to be kept, but got %v", checksums)
+	}
+	if out.String() != digest+"  "+key+"\n" {
+		t.Errorf("Expected the new checksum to be reported, but got %q", out.String())
+	}
+}
+
+func TestGetExpectedSha256(t *testing.T) {
+	current, err := platforms.CurrentPlatform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := platforms.Platform{OS: "windows", Arch: "x86_64"}
+	if current == other {
+		other = platforms.Platform{OS: "linux", Arch: "x86_64"}
+	}
+	filename, err := platforms.DetermineBazelFilenameForPlatform(fakeBazelVersion, current, false, config.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherFilename, err := platforms.DetermineBazelFilenameForPlatform(fakeBazelVersion, other, false, config.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "checksums.txt")
+	contents := strings.Repeat("a", 64) + "  " + filename + "\n" +
+		strings.Repeat("b", 64) + "  otherfork/" + filename + "\n" +
+		strings.Repeat("c", 64) + "  " + otherFilename + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	verified := strings.Repeat("d", 64)
+	pinned := config.Static(map[string]string{
+		ChecksumsFileEnv:         path,
+		"BAZELISK_VERIFY_SHA256": verified,
+	})
+
+	tests := []struct {
+		fork     string
+		platform platforms.Platform
+		filename string
+		want     string
+	}{
+		{versions.BazelUpstream, current, filename, verified},
+		{versions.BazelUpstream, other, otherFilename, strings.Repeat("c", 64)},
+		{"otherfork", other, otherFilename, ""},
+	}
+	for _, tc := range tests {
+		got, err := getExpectedSha256(tc.fork, tc.filename, tc.platform, pinned)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("Expected %s/%s to have digest %q, but got %q", tc.fork, tc.filename, tc.want, got)
+		}
+	}
+
+	unpinned := config.Static(map[string]string{ChecksumsFileEnv: path})
+	if got, _ := getExpectedSha256("otherfork", filename, current, unpinned); got != strings.Repeat("b", 64) {
+		t.Errorf("Expected the checksum of the fork's binary, but got %q", got)
+	}
+}
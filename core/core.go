@@ -5,6 +5,7 @@ package core
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
@@ -37,11 +38,25 @@ const (
 	defaultWrapperDirectory = "./tools"
 	defaultWrapperName      = "bazel"
 	maxDirLength            = 255
+
+	// SharedCacheEnv is the name of the environment variable that stores a list of read-only directories with pre-provisioned Bazel binaries.
+	// They have the same layout as the Bazelisk home directory and are separated by the OS-specific path list separator.
+	SharedCacheEnv = "BAZELISK_SHARED_CACHE"
+
+	// ExecEnv is the name of the environment variable that controls whether Bazelisk replaces its own process with Bazel (see ExecBazel).
+	// Setting it to "0" or "false" makes Bazelisk always run Bazel as a child process.
+	ExecEnv = "BAZELISK_EXEC"
 )
 
 var (
 	// BazeliskVersion is filled in via x_defs when building a release.
 	BazeliskVersion = "development"
+
+	// ExecBazel makes RunBazelisk replace the Bazelisk process with Bazel (or the tools/bazel wrapper) on Unix instead of running it
+	// as a child process, as long as Bazelisk has nothing left to do once Bazel exits. This way signals, job control and process
+	// accounting behave exactly as if Bazel had been run directly. Only main should enable it, since it would replace any program
+	// that embeds Bazelisk, too.
+	ExecBazel = false
 )
 
 // ArgsFunc is a function that receives a resolved Bazel version and returns the arguments to invoke
@@ -49,14 +64,15 @@ var (
 type ArgsFunc func(resolvedBazelVersion string) []string
 
 // MakeDefaultConfig returns a config based on env and .bazeliskrc files.
-func MakeDefaultConfig() config.Config {
+// It returns an error if one of the .bazeliskrc files cannot be read.
+func MakeDefaultConfig() (config.Config, error) {
 	configs := []config.Config{config.FromEnv()}
 
 	workspaceConfigPath, err := config.LocateWorkspaceConfigFile()
 	if err == nil {
 		c, err := config.FromFile(workspaceConfigPath)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		configs = append(configs, c)
 	}
@@ -65,11 +81,11 @@ func MakeDefaultConfig() config.Config {
 	if err == nil {
 		c, err := config.FromFile(userConfigPath)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		configs = append(configs, c)
 	}
-	return config.Layered(configs...)
+	return config.WithCommands(config.Layered(configs...)), nil
 }
 
 // RunBazelisk runs the main Bazelisk logic for the given arguments and Bazel repositories.
@@ -80,8 +96,11 @@ func RunBazelisk(args []string, repos *Repositories) (int, error) {
 // RunBazeliskWithArgsFunc runs the main Bazelisk logic for the given ArgsFunc and Bazel
 // repositories.
 func RunBazeliskWithArgsFunc(argsFunc ArgsFunc, repos *Repositories) (int, error) {
-
-	return RunBazeliskWithArgsFuncAndConfig(argsFunc, repos, MakeDefaultConfig())
+	config, err := MakeDefaultConfig()
+	if err != nil {
+		return -1, err
+	}
+	return RunBazeliskWithArgsFuncAndConfig(argsFunc, repos, config)
 }
 
 // RunBazeliskWithArgsFuncAndConfig runs the main Bazelisk logic for the given ArgsFunc and Bazel
@@ -93,16 +112,52 @@ func RunBazeliskWithArgsFuncAndConfig(argsFunc ArgsFunc, repos *Repositories, co
 // RunBazeliskWithArgsFuncAndConfigAndOut runs the main Bazelisk logic for the given ArgsFunc and Bazel
 // repositories and config, writing its stdout to the passed writer.
 func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositories, config config.Config, out io.Writer) (int, error) {
-	httputil.UserAgent = getUserAgent(config)
+	return RunBazeliskContext(context.Background(), argsFunc, repos, config, out)
+}
 
-	bazeliskHome, err := getBazeliskHome(config)
+// RunBazeliskContext is like RunBazeliskWithArgsFuncAndConfigAndOut, but stops resolving and downloading Bazel and terminates
+// a running Bazel process once the context is done. An interrupt signal (e.g. Ctrl-C) during a download cancels it, too.
+func RunBazeliskContext(ctx context.Context, argsFunc ArgsFunc, repos *Repositories, config config.Config, out io.Writer) (int, error) {
+	bazeliskHome, err := initialize(config)
 	if err != nil {
-		return -1, fmt.Errorf("could not determine Bazelisk home directory: %v", err)
+		return -1, err
 	}
 
-	err = os.MkdirAll(bazeliskHome, 0755)
-	if err != nil {
-		return -1, fmt.Errorf("could not create directory %s: %v", bazeliskHome, err)
+	// The arguments are needed before Bazel is downloaded, so we don't know which exact
+	// version it is, yet. The same is true for local Bazel binaries.
+	resolvedBazelVersion := "unknown"
+	args := argsFunc(resolvedBazelVersion)
+
+	// --update_checksums must be the first argument. It doesn't run Bazel.
+	if len(args) > 0 && args[0] == "--update_checksums" {
+		downloadCtx, stop := interruptible(ctx)
+		defer stop()
+		return updateChecksums(downloadCtx, args[1:], bazeliskHome, repos, config, out)
+	}
+
+	// --cache_list, --cache_prune and --cache_verify must be the first argument. They don't run Bazel.
+	if len(args) > 0 && (args[0] == "--cache_list" || args[0] == "--cache_prune" || args[0] == "--cache_verify") {
+		return runCacheCommand(args[0], args[1:], bazeliskHome, out)
+	}
+
+	// --prefetch must be the first argument. It doesn't run Bazel.
+	if len(args) > 0 && args[0] == "--prefetch" {
+		downloadCtx, stop := interruptible(ctx)
+		defer stop()
+		return prefetch(downloadCtx, args[1:], bazeliskHome, repos, config, out)
+	}
+
+	// --serve must be the first argument. It doesn't run Bazel.
+	if len(args) > 0 && (args[0] == "--serve" || strings.HasPrefix(args[0], "--serve=")) {
+		if len(args) > 1 {
+			return -1, fmt.Errorf("unexpected arguments for --serve: %v", args[1:])
+		}
+		return serveMirror(ctx, args[0], bazeliskHome, repos, config)
+	}
+
+	// --export_bundle and --import_bundle must be the first argument. They don't run Bazel.
+	if len(args) > 0 && (strings.HasPrefix(args[0], "--export_bundle") || strings.HasPrefix(args[0], "--import_bundle")) {
+		return runBundleCommand(args[0], args[1:], bazeliskHome, out)
 	}
 
 	bazelVersionString, err := GetBazelVersion(config)
@@ -115,16 +170,14 @@ func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositori
 		return -1, fmt.Errorf("could not expand home directory in path: %v", err)
 	}
 
-	// If the Bazel version is an absolute path to a Bazel binary in the filesystem, we can
-	// use it directly. In that case, we don't know which exact version it is, though.
-	resolvedBazelVersion := "unknown"
-
 	// If we aren't using a local Bazel binary, we'll have to parse the version string and
 	// download the version that the user wants.
 	if !filepath.IsAbs(bazelPath) {
-		bazelPath, err = downloadBazel(bazelVersionString, bazeliskHome, repos, config)
+		downloadCtx, stop := interruptible(ctx)
+		bazelPath, err = downloadBazel(downloadCtx, bazelVersionString, bazeliskHome, repos, config)
+		stop()
 		if err != nil {
-			return -1, fmt.Errorf("could not download Bazel: %v", err)
+			return -1, fmt.Errorf("could not download Bazel: %w", err)
 		}
 	} else {
 		baseDirectory := filepath.Join(bazeliskHome, "local")
@@ -134,8 +187,6 @@ func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositori
 		}
 	}
 
-	args := argsFunc(resolvedBazelVersion)
-
 	// --print_env must be the first argument.
 	if len(args) > 0 && args[0] == "--print_env" {
 		// print environment variables for sub-processes
@@ -152,12 +203,16 @@ func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositori
 		if err != nil {
 			return -1, err
 		}
-		newFlags, err := getIncompatibleFlags(bazelPath, cmd, config)
+		newFlags, err := getIncompatibleFlags(ctx, bazelPath, cmd, config)
 		if err != nil {
 			return -1, fmt.Errorf("could not get the list of incompatible flags: %v", err)
 		}
 		if args[0] == "--migrate" {
-			migrate(bazelPath, args[1:], newFlags, config)
+			result, err := migrate(ctx, bazelPath, args[1:], newFlags, config)
+			if err != nil {
+				return -1, err
+			}
+			return result.exitCode(), nil
 		} else {
 			// When --strict is present, it expands to the list of --incompatible_ flags
 			// that should be enabled for the given Bazel version.
@@ -168,13 +223,11 @@ func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositori
 		if !strings.HasPrefix(args[0], "--bisect=") {
 			return -1, fmt.Errorf("Error: --bisect must have a value. Expected format: '--bisect=[~]<good bazel commit>..<bad bazel commit>'")
 		}
-		value := args[0][len("--bisect="):]
-		commits := strings.Split(value, "..")
-		if len(commits) == 2 {
-			bisect(commits[0], commits[1], args[1:], bazeliskHome, repos, config)
-		} else {
-			return -1, fmt.Errorf("Error: Invalid format for --bisect. Expected format: '--bisect=[~]<good bazel commit>..<bad bazel commit>'")
+		result, err := runBisect(ctx, args[0][len("--bisect="):], args[1:], bazeliskHome, repos, config)
+		if err != nil {
+			return -1, err
 		}
+		return result.ExitCode(), nil
 	}
 
 	// print bazelisk version information if "version" is the first argument
@@ -197,13 +250,38 @@ func RunBazeliskWithArgsFuncAndConfigAndOut(argsFunc ArgsFunc, repos *Repositori
 		}
 	}
 
-	exitCode, err := runBazel(bazelPath, args, out, config)
+	if shouldExecBazel(ctx, out, config) {
+		cmd := makeBazelCmd(bazelPath, args, nil, config)
+		// execBazel only returns if Bazel could not be started.
+		return -1, fmt.Errorf("could not run Bazel: %w", startError(cmd, bazelPath, execBazel(cmd)))
+	}
+
+	exitCode, err := runBazel(ctx, bazelPath, args, out, config)
 	if err != nil {
-		return -1, fmt.Errorf("could not run Bazel: %v", err)
+		return -1, fmt.Errorf("could not run Bazel: %w", err)
 	}
 	return exitCode, nil
 }
 
+// shouldExecBazel returns true if Bazelisk should replace its own process with Bazel, which is only possible if Bazelisk neither
+// needs the output of Bazel nor has to terminate it once the context is done.
+func shouldExecBazel(ctx context.Context, out io.Writer, config config.Config) bool {
+	if !ExecBazel || !canExecBazel || out != nil || ctx.Done() != nil {
+		return false
+	}
+	switch strings.ToLower(config.Get(ExecEnv)) {
+	case "0", "false", "no", "n":
+		return false
+	}
+	return true
+}
+
+// interruptible returns a context that is also cancelled by an interrupt signal, so that Bazelisk can clean up after itself
+// when it is interrupted during a download. It must not be used while Bazel runs, since Bazel handles interrupts itself.
+func interruptible(ctx context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(ctx, os.Interrupt)
+}
+
 func getBazelCommand(args []string) (string, error) {
 	for _, a := range args {
 		if !strings.HasPrefix(a, "-") {
@@ -213,6 +291,29 @@ func getBazelCommand(args []string) (string, error) {
 	return "", fmt.Errorf("could not find a valid Bazel command in %q. Please run `bazel help` if you need help on how to use Bazel", strings.Join(args, " "))
 }
 
+// initialize applies the HTTP settings of the config and creates the Bazelisk home directory, whose path it returns.
+func initialize(config config.Config) (string, error) {
+	httputil.UserAgent = getUserAgent(config)
+	if err := httputil.ConfigureTransport(config); err != nil {
+		return "", fmt.Errorf("could not configure HTTP transport: %v", err)
+	}
+	if err := httputil.ConfigureAuthentication(config); err != nil {
+		return "", fmt.Errorf("could not configure HTTP authentication: %v", err)
+	}
+	if err := httputil.ConfigureRetries(config); err != nil {
+		return "", fmt.Errorf("could not configure HTTP retries: %v", err)
+	}
+
+	bazeliskHome, err := getBazeliskHome(config)
+	if err != nil {
+		return "", fmt.Errorf("could not determine Bazelisk home directory: %v", err)
+	}
+	if err := os.MkdirAll(bazeliskHome, 0755); err != nil {
+		return "", fmt.Errorf("could not create directory %s: %v", bazeliskHome, err)
+	}
+	return bazeliskHome, nil
+}
+
 // getBazeliskHome returns the path to the Bazelisk home directory.
 func getBazeliskHome(config config.Config) (string, error) {
 	bazeliskHome := config.Get("BAZELISK_HOME_" + strings.ToUpper(runtime.GOOS))
@@ -243,6 +344,21 @@ func getBazeliskHome(config config.Config) (string, error) {
 	return bazeliskHome, nil
 }
 
+// getSharedCaches returns the read-only cache directories in BAZELISK_SHARED_CACHE, which have the same layout as the Bazelisk home directory.
+func getSharedCaches(config config.Config) []string {
+	var caches []string
+	for _, dir := range filepath.SplitList(config.Get(SharedCacheEnv)) {
+		if dir == "" {
+			continue
+		}
+		if expanded, err := homedir.Expand(dir); err == nil {
+			dir = expanded
+		}
+		caches = append(caches, os.ExpandEnv(dir))
+	}
+	return caches
+}
+
 func getUserAgent(config config.Config) string {
 	agent := config.Get("BAZELISK_USER_AGENT")
 	if len(agent) > 0 {
@@ -338,27 +454,36 @@ func parseBazelForkAndVersion(bazelForkAndVersion string) (string, string, error
 	return bazelFork, bazelVersion, nil
 }
 
-func downloadBazel(bazelVersionString string, bazeliskHome string, repos *Repositories, config config.Config) (string, error) {
+func downloadBazel(ctx context.Context, bazelVersionString string, bazeliskHome string, repos *Repositories, config config.Config) (string, error) {
 	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
 	if err != nil {
-		return "", fmt.Errorf("could not parse Bazel fork and version: %v", err)
+		return "", &VersionParseError{Version: bazelVersionString, Err: fmt.Errorf("could not parse Bazel fork and version: %v", err)}
 	}
 
-	resolvedBazelVersion, downloader, err := repos.ResolveVersion(bazeliskHome, bazelFork, bazelVersion, config)
+	resolvedBazelVersion, downloader, err := repos.ResolveVersionContext(ctx, bazeliskHome, bazelFork, bazelVersion, config)
 	if err != nil {
-		return "", fmt.Errorf("could not resolve the version '%s' to an actual version number: %v", bazelVersion, err)
+		return "", fmt.Errorf("could not resolve the version '%s' to an actual version number: %w", bazelVersion, err)
 	}
 
-	bazelForkOrURL := dirForURL(config.Get(BaseURLEnv))
-	if len(bazelForkOrURL) == 0 {
-		bazelForkOrURL = bazelFork
+	platform, err := platforms.CurrentPlatform()
+	if err != nil {
+		return "", err
 	}
 
-	bazelPath, err := downloadBazelIfNecessary(resolvedBazelVersion, bazeliskHome, bazelForkOrURL, repos, config, downloader)
+	bazelPath, err := downloadBazelIfNecessary(ctx, resolvedBazelVersion, platform, bazeliskHome, bazelFork, dirForForkOrURL(bazelFork, config), repos, config, downloader)
 	return bazelPath, err
 }
 
-// downloadBazelIfNecessary returns a path to a bazel which can be run, which may have been cached.
+// dirForForkOrURL returns the name of the metadata directory for binaries from the given fork, or from BAZELISK_BASE_URL if it is set.
+func dirForForkOrURL(bazelFork string, config config.Config) string {
+	if dir := dirForURL(config.Get(BaseURLEnv)); len(dir) > 0 {
+		return dir
+	}
+	return bazelFork
+}
+
+// downloadBazelIfNecessary returns a path to a bazel for the given platform, which may have been cached.
+// Only binaries for the current platform can be run, the others are merely prefetched.
 // The directory it returns may depend on version and bazeliskHome, but does not depend on bazelForkOrURLDirName.
 // This is important, as the directory may be added to $PATH, and varying the path for equivalent files may cause unnecessary repository rule cache invalidations.
 // Where a file was downloaded from shouldn't affect cache behaviour of Bazel invocations.
@@ -367,32 +492,79 @@ func downloadBazel(bazelVersionString string, bazeliskHome string, repos *Reposi
 //
 //	downloads/metadata/[fork-or-url]/bazel-[version-os-etc] is a text file containing a hex sha256 of the contents of the downloaded bazel file.
 //	downloads/sha256/[sha256]/bin/bazel[extension] contains the bazel with a particular sha256.
-func downloadBazelIfNecessary(version string, bazeliskHome string, bazelForkOrURLDirName string, repos *Repositories, config config.Config, downloader DownloadFunc) (string, error) {
-	pathSegment, err := platforms.DetermineBazelFilename(version, false, config)
+//	downloads/_locks/[sha256 of fork-or-url and version-os-etc].lock is held by the process that is currently downloading that bazel.
+func downloadBazelIfNecessary(ctx context.Context, version string, platform platforms.Platform, bazeliskHome string, bazelFork string, bazelForkOrURLDirName string, repos *Repositories, config config.Config, downloader DownloadFunc) (string, error) {
+	pathSegment, err := platforms.DetermineBazelFilenameForPlatform(version, platform, false, config)
 	if err != nil {
 		return "", fmt.Errorf("could not determine path segment to use for Bazel binary: %v", err)
 	}
 
-	destFile := "bazel" + platforms.DetermineExecutableFilenameSuffix()
+	destFile := "bazel" + platform.ExecutableFilenameSuffix()
+
+	expectedSha256, err := getExpectedSha256(bazelFork, pathSegment, platform, config)
+	if err != nil {
+		return "", err
+	}
 
 	mappingPath := filepath.Join(bazeliskHome, "downloads", "metadata", bazelForkOrURLDirName, pathSegment)
-	digestFromMappingFile, err := os.ReadFile(mappingPath)
-	if err == nil {
-		pathToBazelInCAS := filepath.Join(bazeliskHome, "downloads", "sha256", string(digestFromMappingFile), "bin", destFile)
-		if _, err := os.Stat(pathToBazelInCAS); err == nil {
-			return pathToBazelInCAS, nil
+	lookupCache := func() (string, bool) {
+		// Read-only shared caches take precedence, so that users don't need their own copy of pre-provisioned binaries.
+		for _, cacheDir := range append(getSharedCaches(config), bazeliskHome) {
+			if pathToBazelInCAS, ok := lookupCachedBazel(cacheDir, bazelForkOrURLDirName, pathSegment, destFile, expectedSha256, config); ok {
+				if cacheDir == bazeliskHome {
+					markUsed(pathToBazelInCAS)
+				}
+				return pathToBazelInCAS, true
+			}
 		}
+		return "", false
 	}
 
-	pathToBazelInCAS, downloadedDigest, err := downloadBazelToCAS(version, bazeliskHome, repos, config, downloader)
+	if pathToBazelInCAS, ok := lookupCache(); ok {
+		return pathToBazelInCAS, nil
+	}
+
+	// Only one process should download a given binary at a time. The others wait for it and then use its result.
+	lock, err := acquireLock(ctx, downloadLockPath(bazeliskHome, bazelForkOrURLDirName, pathSegment))
 	if err != nil {
-		return "", fmt.Errorf("failed to download bazel: %w", err)
+		return "", err
+	}
+	defer lock.release()
+
+	if pathToBazelInCAS, ok := lookupCache(); ok {
+		return pathToBazelInCAS, nil
+	}
+
+	remoteCache, err := getRemoteCache(config)
+	if err != nil {
+		return "", err
+	}
+
+	var pathToBazelInCAS, downloadedDigest string
+	var provenance *provenanceRecord
+	// Binaries from the remote cache have no provenance record, so they can't be used if provenance has to be verified.
+	if digest := knownDigest(mappingPath, expectedSha256); remoteCache != "" && digest != "" && !isProvenanceVerificationEnabled(config) {
+		pathToBazelInCAS, err = fetchFromRemoteCache(ctx, remoteCache, digest, platform, bazeliskHome, config)
+		if err != nil && ctx.Err() != nil {
+			return "", err
+		} else if err != nil {
+			log.Printf("Warning: could not fetch Bazel binary from remote cache, downloading it instead: %v", err)
+		} else {
+			downloadedDigest = digest
+		}
+	}
+	fromRemoteCache := pathToBazelInCAS != ""
+
+	if !fromRemoteCache {
+		pathToBazelInCAS, downloadedDigest, provenance, err = downloadBazelToCAS(ctx, version, platform, bazeliskHome, repos, config, downloader, expectedSha256)
+		if err != nil {
+			return "", fmt.Errorf("failed to download bazel: %w", err)
+		}
 	}
 
-	expectedSha256 := strings.ToLower(config.Get("BAZELISK_VERIFY_SHA256"))
 	if len(expectedSha256) > 0 {
 		if expectedSha256 != downloadedDigest {
-			return "", fmt.Errorf("%s has sha256=%s but need sha256=%s", pathToBazelInCAS, downloadedDigest, expectedSha256)
+			return "", &ChecksumMismatchError{Path: pathToBazelInCAS, Actual: downloadedDigest, Expected: expectedSha256}
 		}
 	}
 
@@ -400,9 +572,43 @@ func downloadBazelIfNecessary(version string, bazeliskHome string, bazelForkOrUR
 		return "", fmt.Errorf("failed to write mapping file after downloading bazel: %w", err)
 	}
 
+	if provenance != nil {
+		if err := writeProvenanceRecord(mappingPath, provenance); err != nil {
+			return "", fmt.Errorf("failed to record provenance after downloading bazel: %w", err)
+		}
+	}
+
+	if remoteCache != "" && !fromRemoteCache {
+		uploadToRemoteCache(ctx, remoteCache, pathToBazelInCAS, downloadedDigest)
+	}
+
+	markUsed(pathToBazelInCAS)
+	if err := enforceCacheSizeLimit(bazeliskHome, downloadedDigest, config); err != nil {
+		log.Printf("Warning: could not limit the size of the download cache: %v", err)
+	}
 	return pathToBazelInCAS, nil
 }
 
+// lookupCachedBazel returns the path of the given Bazel binary in the CAS of the given cache directory (which has the same layout as bazeliskHome),
+// as long as it can be used without downloading it again.
+func lookupCachedBazel(cacheDir, bazelForkOrURLDirName, pathSegment, destFile, expectedSha256 string, config config.Config) (string, bool) {
+	mappingPath := filepath.Join(cacheDir, "downloads", "metadata", bazelForkOrURLDirName, pathSegment)
+	digestFromMappingFile, err := os.ReadFile(mappingPath)
+	// A cached binary with a different digest than the expected one has to be downloaded (and verified) again.
+	if err != nil || (expectedSha256 != "" && expectedSha256 != string(digestFromMappingFile)) {
+		return "", false
+	}
+	pathToBazelInCAS := filepath.Join(cacheDir, "downloads", "sha256", string(digestFromMappingFile), "bin", destFile)
+	if _, err := os.Stat(pathToBazelInCAS); err != nil {
+		return "", false
+	}
+	// Binaries that were downloaded before provenance verification was enabled have to be downloaded (and verified) again.
+	if isProvenanceVerificationEnabled(config) && !hasProvenanceRecord(mappingPath, string(digestFromMappingFile)) {
+		return "", false
+	}
+	return pathToBazelInCAS, true
+}
+
 func atomicWriteFile(path string, contents []byte, perm os.FileMode) error {
 	parent := filepath.Dir(path)
 	if err := os.MkdirAll(parent, 0755); err != nil {
@@ -424,14 +630,15 @@ func atomicWriteFile(path string, contents []byte, perm os.FileMode) error {
 	return nil
 }
 
-func downloadBazelToCAS(version string, bazeliskHome string, repos *Repositories, config config.Config, downloader DownloadFunc) (string, string, error) {
+// downloadBazelToCAS downloads the given Bazel binary, verifies it and moves it into the CAS. If expectedSha256 is not empty,
+// binaries with a different digest are rejected before they are run or admitted into the CAS.
+func downloadBazelToCAS(ctx context.Context, version string, platform platforms.Platform, bazeliskHome string, repos *Repositories, config config.Config, downloader DownloadFunc, expectedSha256 string) (string, string, *provenanceRecord, error) {
 	downloadsDir := filepath.Join(bazeliskHome, "downloads")
 	temporaryDownloadDir := filepath.Join(downloadsDir, "_tmp")
-	casDir := filepath.Join(bazeliskHome, "downloads", "sha256")
 
 	tmpDestFileBytes := make([]byte, 32)
 	if _, err := rand.Read(tmpDestFileBytes); err != nil {
-		return "", "", fmt.Errorf("failed to generate temporary file name: %w", err)
+		return "", "", nil, fmt.Errorf("failed to generate temporary file name: %w", err)
 	}
 	tmpDestFile := fmt.Sprintf("%x", tmpDestFileBytes)
 
@@ -440,53 +647,84 @@ func downloadBazelToCAS(version string, bazeliskHome string, repos *Repositories
 	baseURL := config.Get(BaseURLEnv)
 	formatURL := config.Get(FormatURLEnv)
 	if baseURL != "" && formatURL != "" {
-		return "", "", fmt.Errorf("cannot set %s and %s at once", BaseURLEnv, FormatURLEnv)
+		return "", "", nil, fmt.Errorf("cannot set %s and %s at once", BaseURLEnv, FormatURLEnv)
 	} else if formatURL != "" {
-		tmpDestPath, err = repos.DownloadFromFormatURL(config, formatURL, version, temporaryDownloadDir, tmpDestFile)
+		tmpDestPath, err = repos.DownloadFromFormatURLContext(ctx, config, formatURL, version, platform, temporaryDownloadDir, tmpDestFile)
 	} else if baseURL != "" {
-		tmpDestPath, err = repos.DownloadFromBaseURL(baseURL, version, temporaryDownloadDir, tmpDestFile, config)
+		tmpDestPath, err = repos.DownloadFromBaseURLContext(ctx, baseURL, version, platform, temporaryDownloadDir, tmpDestFile, config)
 	} else {
-		tmpDestPath, err = downloader(temporaryDownloadDir, tmpDestFile)
+		tmpDestPath, err = downloader(platform, temporaryDownloadDir, tmpDestFile)
 	}
 	if err != nil {
-		return "", "", fmt.Errorf("failed to download bazel: %w", err)
+		return "", "", nil, fmt.Errorf("failed to download bazel: %w", err)
+	}
+
+	sourceURL := takeSourceURL(tmpDestPath)
+	if err := validateBinary(tmpDestPath, sourceURL); err != nil {
+		return "", "", nil, rejectDownload(tmpDestPath, bazeliskHome, err)
 	}
 
 	f, err := os.Open(tmpDestPath)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open downloaded bazel to digest it: %w", err)
+		return "", "", nil, fmt.Errorf("failed to open downloaded bazel to digest it: %w", err)
 	}
 
 	h := sha256.New()
 	if _, err := io.Copy(h, f); err != nil {
 		f.Close()
-		return "", "", fmt.Errorf("cannot compute sha256 of %s after download: %v", tmpDestPath, err)
+		return "", "", nil, fmt.Errorf("cannot compute sha256 of %s after download: %v", tmpDestPath, err)
 	}
 	f.Close()
 	actualSha256 := strings.ToLower(fmt.Sprintf("%x", h.Sum(nil)))
 
-	bazelInCASBasename := "bazel" + platforms.DetermineExecutableFilenameSuffix()
-	pathToBazelInCAS := filepath.Join(casDir, actualSha256, "bin", bazelInCASBasename)
+	provenance, err := verifySidecars(tmpDestPath, actualSha256, config)
+	if err != nil {
+		os.Remove(tmpDestPath)
+		return "", "", nil, err
+	}
+
+	if expectedSha256 != "" && expectedSha256 != actualSha256 {
+		os.Remove(tmpDestPath)
+		return "", "", nil, &ChecksumMismatchError{Path: tmpDestPath, Actual: actualSha256, Expected: expectedSha256}
+	}
+
+	// The binary is only run once it's known to be the expected one.
+	if err := smokeTestBinary(tmpDestPath, sourceURL, platform, config); err != nil {
+		return "", "", nil, rejectDownload(tmpDestPath, bazeliskHome, err)
+	}
+
+	pathToBazelInCAS, err := moveIntoCAS(tmpDestPath, actualSha256, platform, bazeliskHome)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return pathToBazelInCAS, actualSha256, provenance, nil
+}
+
+// moveIntoCAS moves the verified Bazel binary at tmpDestPath to downloads/sha256/[sha256]/bin/bazel[extension] and returns its new path.
+func moveIntoCAS(tmpDestPath, sha256 string, platform platforms.Platform, bazeliskHome string) (string, error) {
+	bazelInCASBasename := "bazel" + platform.ExecutableFilenameSuffix()
+	pathToBazelInCAS := filepath.Join(bazeliskHome, "downloads", "sha256", sha256, "bin", bazelInCASBasename)
 	dirForBazelInCAS := filepath.Dir(pathToBazelInCAS)
 	if err := os.MkdirAll(dirForBazelInCAS, 0755); err != nil {
-		return "", "", fmt.Errorf("failed to MkdirAll parent of %s: %w", pathToBazelInCAS, err)
+		return "", fmt.Errorf("failed to MkdirAll parent of %s: %w", pathToBazelInCAS, err)
 	}
 
 	tmpPathFile, err := os.CreateTemp(dirForBazelInCAS, bazelInCASBasename+".tmp")
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create temporary file in %s: %w", dirForBazelInCAS, err)
+		return "", fmt.Errorf("failed to create temporary file in %s: %w", dirForBazelInCAS, err)
 	}
 	tmpPathFile.Close()
 	defer os.Remove(tmpPathFile.Name())
 	tmpPathInCorrectDirectory := tmpPathFile.Name()
 	if err := os.Rename(tmpDestPath, tmpPathInCorrectDirectory); err != nil {
-		return "", "", fmt.Errorf("failed to move %s to %s: %w", tmpDestPath, tmpPathInCorrectDirectory, err)
+		return "", fmt.Errorf("failed to move %s to %s: %w", tmpDestPath, tmpPathInCorrectDirectory, err)
 	}
 	if err := os.Rename(tmpPathInCorrectDirectory, pathToBazelInCAS); err != nil {
-		return "", "", fmt.Errorf("failed to move %s to %s: %w", tmpPathInCorrectDirectory, pathToBazelInCAS, err)
+		return "", fmt.Errorf("failed to move %s to %s: %w", tmpPathInCorrectDirectory, pathToBazelInCAS, err)
 	}
-
-	return pathToBazelInCAS, actualSha256, nil
+	// Until the caller has written the metadata entry, only the recent use protects the binary from being removed by other processes.
+	markUsed(pathToBazelInCAS)
+	return pathToBazelInCAS, nil
 }
 
 func copyFile(src, dst string, perm os.FileMode) error {
@@ -612,14 +850,33 @@ func makeBazelCmd(bazel string, args []string, out io.Writer, config config.Conf
 	return cmd
 }
 
-func runBazel(bazel string, args []string, out io.Writer, config config.Config) (int, error) {
+// startError returns the error for a command that was supposed to run the given Bazel binary, but could not be started.
+func startError(cmd *exec.Cmd, bazel string, err error) error {
+	if wrapper := cmd.Args[0]; wrapper != bazel {
+		return &WrapperError{Path: wrapper, Err: err}
+	}
+	return fmt.Errorf("could not start Bazel: %v", err)
+}
+
+func runBazel(ctx context.Context, bazel string, args []string, out io.Writer, config config.Config) (int, error) {
 	cmd := makeBazelCmd(bazel, args, out, config)
 	err := cmd.Start()
 	if err != nil {
-		return 1, fmt.Errorf("could not start Bazel: %v", err)
+		return 1, startError(cmd, bazel, err)
 	}
 
-	c := make(chan os.Signal)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Like SIGTERM, cancellation terminates our child process.
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		s := <-c
@@ -631,6 +888,9 @@ func runBazel(bazel string, args []string, out io.Writer, config config.Config)
 	}()
 
 	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return 1, fmt.Errorf("Bazel was terminated: %w", ctx.Err())
+	}
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
 			waitStatus := exitError.Sys().(syscall.WaitStatus)
@@ -642,14 +902,14 @@ func runBazel(bazel string, args []string, out io.Writer, config config.Config)
 }
 
 // getIncompatibleFlags returns all incompatible flags for the current Bazel command in alphabetical order.
-func getIncompatibleFlags(bazelPath, cmd string, config config.Config) ([]string, error) {
+func getIncompatibleFlags(ctx context.Context, bazelPath, cmd string, config config.Config) ([]string, error) {
 	var incompatibleFlagsStr = config.Get("BAZELISK_INCOMPATIBLE_FLAGS")
 	if len(incompatibleFlagsStr) > 0 {
 		return strings.Split(incompatibleFlagsStr, ","), nil
 	}
 
 	out := strings.Builder{}
-	if _, err := runBazel(bazelPath, []string{"help", cmd, "--short"}, &out, config); err != nil {
+	if _, err := runBazel(ctx, bazelPath, []string{"help", cmd, "--short"}, &out, config); err != nil {
 		return nil, fmt.Errorf("unable to determine incompatible flags with binary %s: %v", bazelPath, err)
 	}
 
@@ -717,42 +977,50 @@ func parseStartupOptions(baseArgs []string) []string {
 	return result
 }
 
-func shutdownIfNeeded(bazelPath string, startupOptions []string, config config.Config) {
+func shutdownIfNeeded(ctx context.Context, bazelPath string, startupOptions []string, config config.Config) error {
 	bazeliskClean := config.Get("BAZELISK_SHUTDOWN")
 	if len(bazeliskClean) == 0 {
-		return
+		return nil
 	}
 
 	args := append(startupOptions, "shutdown")
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err := runBazel(bazelPath, args, nil, config)
+	exitCode, err := runBazel(ctx, bazelPath, args, nil, config)
 	fmt.Printf("\n")
 	if err != nil {
-		log.Fatalf("failed to run bazel shutdown: %v", err)
+		return fmt.Errorf("failed to run bazel shutdown: %w", err)
 	}
 	if exitCode != 0 {
-		fmt.Printf("Failure: shutdown command failed.\n")
-		os.Exit(exitCode)
+		return fmt.Errorf("bazel shutdown failed with exit code %d", exitCode)
 	}
+	return nil
 }
 
-func cleanIfNeeded(bazelPath string, startupOptions []string, config config.Config) {
+func cleanIfNeeded(ctx context.Context, bazelPath string, startupOptions []string, config config.Config) error {
 	bazeliskClean := config.Get("BAZELISK_CLEAN")
 	if len(bazeliskClean) == 0 {
-		return
+		return nil
 	}
 
 	args := append(startupOptions, "clean", "--expunge")
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err := runBazel(bazelPath, args, nil, config)
+	exitCode, err := runBazel(ctx, bazelPath, args, nil, config)
 	fmt.Printf("\n")
 	if err != nil {
-		log.Fatalf("failed to run clean: %v", err)
+		return fmt.Errorf("failed to run clean: %w", err)
 	}
 	if exitCode != 0 {
-		fmt.Printf("Failure: clean command failed.\n")
-		os.Exit(exitCode)
+		return fmt.Errorf("bazel clean failed with exit code %d", exitCode)
 	}
+	return nil
+}
+
+// prepareBazelRun shuts Bazel down and/or cleans the output base before a run, if requested via BAZELISK_SHUTDOWN and BAZELISK_CLEAN.
+func prepareBazelRun(ctx context.Context, bazelPath string, startupOptions []string, config config.Config) error {
+	if err := shutdownIfNeeded(ctx, bazelPath, startupOptions, config); err != nil {
+		return err
+	}
+	return cleanIfNeeded(ctx, bazelPath, startupOptions, config)
 }
 
 type parentCommit struct {
@@ -770,36 +1038,52 @@ type compareResponse struct {
 	MergeBaseCommit commit   `json:"merge_base_commit"`
 }
 
-func sendRequest(url string, config config.Config) (*http.Response, error) {
-	client := &http.Client{}
+func sendRequest(ctx context.Context, url string, config config.Config) (*http.Response, error) {
+	client := httputil.NewClient()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	githubToken := config.Get("BAZELISK_GITHUB_TOKEN")
+	var auth string
+	githubToken := GetGitHubToken(config)
 	if len(githubToken) != 0 {
-		req.Header.Set("Authorization", fmt.Sprintf("token %s", githubToken))
+		auth = fmt.Sprintf("token %s", githubToken)
+	}
+	if err := httputil.Authenticate(req, auth); err != nil {
+		return nil, err
 	}
 
 	return client.Do(req)
 }
 
-func getBazelCommitsBetween(oldCommit string, newCommit string, config config.Config) (string, []string, error) {
+func getBazelCommitsBetween(ctx context.Context, oldCommit string, newCommit string, config config.Config) (string, []string, error) {
 	commitList := make([]string, 0)
 	page := 1
 	perPage := 250 // 250 is the maximum number of commits per page
+	waitedForRateLimit := false
 
 	for {
 		url := fmt.Sprintf("https://api.github.com/repos/bazelbuild/bazel/compare/%s...%s?page=%d&per_page=%d", oldCommit, newCommit, page, perPage)
 
-		response, err := sendRequest(url, config)
+		response, err := sendRequest(ctx, url, config)
 		if err != nil {
 			return oldCommit, nil, fmt.Errorf("Error fetching commit data: %v", err)
 		}
 		defer response.Body.Close()
 
+		if rateLimitErr := httputil.CheckRateLimit(url, response); rateLimitErr != nil {
+			if !waitedForRateLimit && rateLimitErr.Wait(ctx) {
+				waitedForRateLimit = true
+				continue
+			}
+			if GetGitHubToken(config) == "" {
+				return oldCommit, nil, fmt.Errorf("%w. Set BAZELISK_GITHUB_TOKEN, BAZELISK_GITHUB_TOKEN_COMMAND or GITHUB_TOKEN to get a higher limit", rateLimitErr)
+			}
+			return oldCommit, nil, rateLimitErr
+		}
+
 		body, err := io.ReadAll(response.Body)
 		if err != nil {
 			return oldCommit, nil, fmt.Errorf("Error reading response body: %v", err)
@@ -807,8 +1091,6 @@ func getBazelCommitsBetween(oldCommit string, newCommit string, config config.Co
 
 		if response.StatusCode == http.StatusNotFound {
 			return oldCommit, nil, fmt.Errorf("repository or commit not found: %s", string(body))
-		} else if response.StatusCode == 403 {
-			return oldCommit, nil, fmt.Errorf("github API rate limit hit, consider setting BAZELISK_GITHUB_TOKEN: %s", string(body))
 		} else if response.StatusCode != http.StatusOK {
 			return oldCommit, nil, fmt.Errorf("unexpected response status code %d: %s", response.StatusCode, string(body))
 		}
@@ -842,6 +1124,7 @@ func getBazelCommitsBetween(oldCommit string, newCommit string, config config.Co
 		}
 
 		page++
+		waitedForRateLimit = false
 	}
 
 	if len(commitList) == 0 {
@@ -851,7 +1134,44 @@ func getBazelCommitsBetween(oldCommit string, newCommit string, config config.Co
 	return oldCommit, commitList, nil
 }
 
-func bisect(oldCommit string, newCommit string, args []string, bazeliskHome string, repos *Repositories, config config.Config) {
+// BisectResult is the outcome of bisecting the Bazel commits between a good and a bad commit (or vice versa).
+type BisectResult struct {
+	// FlippingCommit is the first commit at which the outcome changed, or empty if all commits behaved like the old one.
+	FlippingCommit string
+	// OldCommitIs is "good" or "bad", depending on the outcome that the old commit is supposed to have.
+	OldCommitIs string
+	// OldCommitMismatch is true if the old commit didn't have that outcome, i.e. the given good commit was already broken
+	// or the given bad commit was already fixed. No commits are bisected in this case.
+	OldCommitMismatch bool
+}
+
+// ExitCode returns the exit code of --bisect: 1 if the old commit didn't have the expected outcome, and 0 otherwise.
+func (r *BisectResult) ExitCode() int {
+	if r.OldCommitMismatch {
+		return 1
+	}
+	return 0
+}
+
+// Bisect runs --bisect=<value> with the given Bazel arguments, where value has the format [~]<good commit>..<bad commit>,
+// and returns the result instead of only printing it.
+func Bisect(ctx context.Context, value string, args []string, repos *Repositories, config config.Config) (*BisectResult, error) {
+	bazeliskHome, err := initialize(config)
+	if err != nil {
+		return nil, err
+	}
+	return runBisect(ctx, value, args, bazeliskHome, repos, config)
+}
+
+func runBisect(ctx context.Context, value string, args []string, bazeliskHome string, repos *Repositories, config config.Config) (*BisectResult, error) {
+	commits := strings.Split(value, "..")
+	if len(commits) != 2 {
+		return nil, fmt.Errorf("Error: Invalid format for --bisect. Expected format: '--bisect=[~]<good bazel commit>..<bad bazel commit>'")
+	}
+	return bisect(ctx, commits[0], commits[1], args, bazeliskHome, repos, config)
+}
+
+func bisect(ctx context.Context, oldCommit string, newCommit string, args []string, bazeliskHome string, repos *Repositories, config config.Config) (*BisectResult, error) {
 	var oldCommitIs string
 	if strings.HasPrefix(oldCommit, "~") {
 		oldCommit = oldCommit[1:]
@@ -862,21 +1182,23 @@ func bisect(oldCommit string, newCommit string, args []string, bazeliskHome stri
 
 	// 1. Get the list of commits between oldCommit and newCommit
 	fmt.Printf("\n\n--- Getting the list of commits between %s and %s\n\n", oldCommit, newCommit)
-	oldCommit, commitList, err := getBazelCommitsBetween(oldCommit, newCommit, config)
+	oldCommit, commitList, err := getBazelCommitsBetween(ctx, oldCommit, newCommit, config)
 	if err != nil {
-		log.Fatalf("Failed to get commits: %v", err)
+		return nil, fmt.Errorf("failed to get commits: %w", err)
 	}
 
 	// 2. Check if oldCommit is actually good/bad as specified
 	fmt.Printf("\n\n--- Verifying if the given %s Bazel commit (%s) is actually %s\n\n", oldCommitIs, oldCommit, oldCommitIs)
-	bazelExitCode, err := testWithBazelAtCommit(oldCommit, args, bazeliskHome, repos, config)
+	bazelExitCode, err := testWithBazelAtCommit(ctx, oldCommit, args, bazeliskHome, repos, config)
 	if err != nil {
-		log.Fatalf("could not run Bazel: %v", err)
+		return nil, err
 	}
 	if oldCommitIs == "good" && bazelExitCode != 0 {
 		fmt.Printf("Failure: Given good bazel commit is already broken.\n")
+		return &BisectResult{OldCommitIs: oldCommitIs, OldCommitMismatch: true}, nil
 	} else if oldCommitIs == "bad" && bazelExitCode == 0 {
 		fmt.Printf("Failure: Given bad bazel commit is already fixed.\n")
+		return &BisectResult{OldCommitIs: oldCommitIs, OldCommitMismatch: true}, nil
 	}
 
 	// 3. Bisect commits
@@ -887,9 +1209,9 @@ func bisect(oldCommit string, newCommit string, args []string, bazeliskHome stri
 		mid := (left + right) / 2
 		midCommit := commitList[mid]
 		fmt.Printf("\n\n--- Testing with Bazel built at %s, %d commits remaining...\n\n", midCommit, right-left)
-		bazelExitCode, err := testWithBazelAtCommit(midCommit, args, bazeliskHome, repos, config)
+		bazelExitCode, err := testWithBazelAtCommit(ctx, midCommit, args, bazeliskHome, repos, config)
 		if err != nil {
-			log.Fatalf("could not run Bazel: %v", err)
+			return nil, err
 		}
 		if bazelExitCode == 0 {
 			fmt.Printf("\n\n--- Succeeded at %s\n\n", midCommit)
@@ -909,6 +1231,7 @@ func bisect(oldCommit string, newCommit string, args []string, bazeliskHome stri
 	}
 
 	// 4. Print the result
+	result := &BisectResult{OldCommitIs: oldCommitIs}
 	fmt.Printf("\n\n--- Bisect Result\n\n")
 	if right == len(commitList) {
 		if oldCommitIs == "good" {
@@ -918,83 +1241,113 @@ func bisect(oldCommit string, newCommit string, args []string, bazeliskHome stri
 		}
 	} else {
 		flippingCommit := commitList[right]
+		result.FlippingCommit = flippingCommit
 		if oldCommitIs == "good" {
 			fmt.Printf("first bad commit is https://github.com/bazelbuild/bazel/commit/%s\n", flippingCommit)
 		} else {
 			fmt.Printf("first good commit is https://github.com/bazelbuild/bazel/commit/%s\n", flippingCommit)
 		}
 	}
-
-	os.Exit(0)
+	return result, nil
 }
 
-func testWithBazelAtCommit(bazelCommit string, args []string, bazeliskHome string, repos *Repositories, config config.Config) (int, error) {
-	bazelPath, err := downloadBazel(bazelCommit, bazeliskHome, repos, config)
+func testWithBazelAtCommit(ctx context.Context, bazelCommit string, args []string, bazeliskHome string, repos *Repositories, config config.Config) (int, error) {
+	downloadCtx, stop := interruptible(ctx)
+	bazelPath, err := downloadBazel(downloadCtx, bazelCommit, bazeliskHome, repos, config)
+	stop()
 	if err != nil {
-		return 1, fmt.Errorf("could not download Bazel: %v", err)
+		return 1, fmt.Errorf("could not download Bazel: %w", err)
 	}
 	startupOptions := parseStartupOptions(args)
-	shutdownIfNeeded(bazelPath, startupOptions, config)
-	cleanIfNeeded(bazelPath, startupOptions, config)
+	if err := prepareBazelRun(ctx, bazelPath, startupOptions, config); err != nil {
+		return -1, err
+	}
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	bazelExitCode, err := runBazel(bazelPath, args, nil, config)
+	bazelExitCode, err := runBazel(ctx, bazelPath, args, nil, config)
 	if err != nil {
 		return -1, fmt.Errorf("could not run Bazel: %v", err)
 	}
 	return bazelExitCode, nil
 }
 
+// migrationResult is the outcome of running Bazel with the incompatible flags of its version.
+type migrationResult struct {
+	// allFlagsPassed is true if Bazel succeeded with all incompatible flags, i.e. no migration is needed.
+	allFlagsPassed bool
+	// baselineExitCode is the exit code of Bazel without any incompatible flags. It is only set if Bazel failed with all flags.
+	baselineExitCode int
+	// passList and failList contain the flags with which Bazel succeeded and failed, respectively.
+	passList []string
+	failList []string
+}
+
+// exitCode returns the exit code of a --migrate invocation: 0 if no migration is needed, the exit code of Bazel if it fails
+// even without incompatible flags, and 1 otherwise.
+func (r *migrationResult) exitCode() int {
+	if r.allFlagsPassed {
+		return 0
+	}
+	if r.baselineExitCode != 0 {
+		return r.baselineExitCode
+	}
+	return 1
+}
+
 // migrate will run Bazel with each flag separately and report which ones are failing.
-func migrate(bazelPath string, baseArgs []string, flags []string, config config.Config) {
+func migrate(ctx context.Context, bazelPath string, baseArgs []string, flags []string, config config.Config) (*migrationResult, error) {
 	var startupOptions = parseStartupOptions(baseArgs)
+	result := &migrationResult{}
 
 	// 1. Try with all the flags.
 	args := insertArgs(baseArgs, flags)
 	fmt.Printf("\n\n--- Running Bazel with all incompatible flags\n\n")
-	shutdownIfNeeded(bazelPath, startupOptions, config)
-	cleanIfNeeded(bazelPath, startupOptions, config)
+	if err := prepareBazelRun(ctx, bazelPath, startupOptions, config); err != nil {
+		return nil, err
+	}
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err := runBazel(bazelPath, args, nil, config)
+	exitCode, err := runBazel(ctx, bazelPath, args, nil, config)
 	if err != nil {
-		log.Fatalf("could not run Bazel: %v", err)
+		return nil, fmt.Errorf("could not run Bazel: %w", err)
 	}
 	if exitCode == 0 {
 		fmt.Printf("Success: No migration needed.\n")
-		os.Exit(0)
+		result.allFlagsPassed = true
+		return result, nil
 	}
 
 	// 2. Try with no flags, as a sanity check.
 	args = baseArgs
 	fmt.Printf("\n\n--- Running Bazel with no incompatible flags\n\n")
-	shutdownIfNeeded(bazelPath, startupOptions, config)
-	cleanIfNeeded(bazelPath, startupOptions, config)
+	if err := prepareBazelRun(ctx, bazelPath, startupOptions, config); err != nil {
+		return nil, err
+	}
 	fmt.Printf("bazel %s\n", strings.Join(args, " "))
-	exitCode, err = runBazel(bazelPath, args, nil, config)
+	exitCode, err = runBazel(ctx, bazelPath, args, nil, config)
 	if err != nil {
-		log.Fatalf("could not run Bazel: %v", err)
+		return nil, fmt.Errorf("could not run Bazel: %w", err)
 	}
 	if exitCode != 0 {
 		fmt.Printf("Failure: Command failed, even without incompatible flags.\n")
-		os.Exit(exitCode)
+		result.baselineExitCode = exitCode
+		return result, nil
 	}
 
 	// 3. Try with each flag separately.
-	var passList []string
-	var failList []string
 	for _, arg := range flags {
 		args = insertArgs(baseArgs, []string{arg})
 		fmt.Printf("\n\n--- Running Bazel with %s\n\n", arg)
-		shutdownIfNeeded(bazelPath, startupOptions, config)
-		cleanIfNeeded(bazelPath, startupOptions, config)
+		if err := prepareBazelRun(ctx, bazelPath, startupOptions, config); err != nil {
+			return nil, err
+		}
 		fmt.Printf("bazel %s\n", strings.Join(args, " "))
-		exitCode, err = runBazel(bazelPath, args, nil, config)
+		exitCode, err = runBazel(ctx, bazelPath, args, nil, config)
 		if err != nil {
-			log.Fatalf("could not run Bazel: %v", err)
+			return nil, fmt.Errorf("could not run Bazel: %w", err)
 		}
 		if exitCode == 0 {
-			passList = append(passList, arg)
+			result.passList = append(result.passList, arg)
 		} else {
-			failList = append(failList, arg)
+			result.failList = append(result.failList, arg)
 		}
 	}
 
@@ -1007,12 +1360,11 @@ func migrate(bazelPath string, baseArgs []string, flags []string, config config.
 	// 4. Print report
 	fmt.Printf("\n\n+++ Result\n\n")
 	fmt.Printf("Command was successful with the following flags:\n")
-	print(passList)
+	print(result.passList)
 	fmt.Printf("\n")
 	fmt.Printf("Migration is needed for the following flags:\n")
-	print(failList)
-
-	os.Exit(1)
+	print(result.failList)
+	return result, nil
 }
 
 func dirForURL(url string) string {
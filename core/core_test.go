@@ -1,13 +1,23 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
 )
 
 func TestMaybeDelegateToNoWrapper(t *testing.T) {
@@ -168,3 +178,186 @@ func TestMaybeDelegateToPowershellOverBatchWrapper(t *testing.T) {
 		t.Fatalf("Expected to delegate bazel to %q, but got %q", expected, entrypoint)
 	}
 }
+
+func TestDownloadUsesSharedCache(t *testing.T) {
+	sharedCache := t.TempDir()
+	sharedPath, err := downloadFakeBazel(t, sharedCache, map[string]string{BaseURLEnv: serveFakeBazel(t, fakeBazelScript("pre-provisioned bazel"), nil)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Nothing is served anymore, so the binary has to come from the shared cache.
+	bazeliskHome := t.TempDir()
+	path, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:     serveFakeBazel(t, "", nil) + "/missing",
+		SharedCacheEnv: filepath.Join(t.TempDir(), "does-not-exist") + string(os.PathListSeparator) + sharedCache,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if path != sharedPath {
+		t.Fatalf("Expected the binary from the shared cache at %s, but got %s", sharedPath, path)
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads")); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be written to the user's cache")
+	}
+}
+
+func TestMigrateReturnsResultInsteadOfExiting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	bazelPath := filepath.Join(t.TempDir(), "bazel")
+	// Fails whenever --incompatible_b is enabled.
+	script := "#!/bin/sh\nfor arg in \"$@\"; do [ \"$arg\" = --incompatible_b ] && exit 3; done\nexit 0\n"
+	if err := os.WriteFile(bazelPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := migrate(context.Background(), bazelPath, []string{"build", "//..."}, []string{"--incompatible_a", "--incompatible_b"}, config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !slices.Equal(result.passList, []string{"--incompatible_a"}) || !slices.Equal(result.failList, []string{"--incompatible_b"}) {
+		t.Errorf("Expected --incompatible_a to pass and --incompatible_b to fail, but got %+v", result)
+	}
+	if got := result.exitCode(); got != 1 {
+		t.Errorf("exitCode() = %d, want 1", got)
+	}
+
+	result, err = migrate(context.Background(), bazelPath, []string{"build", "//..."}, []string{"--incompatible_a"}, config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := result.exitCode(); got != 0 {
+		t.Errorf("exitCode() = %d, want 0 if no migration is needed", got)
+	}
+}
+
+func TestMigrateReturnsErrorIfShutdownFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	bazelPath := filepath.Join(t.TempDir(), "bazel")
+	if err := os.WriteFile(bazelPath, []byte("#!/bin/sh\n[ \"$1\" = shutdown ] && exit 7\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Static(map[string]string{"BAZELISK_SHUTDOWN": "1"})
+
+	if _, err := migrate(context.Background(), bazelPath, []string{"build"}, []string{"--incompatible_a"}, cfg); err == nil || !strings.Contains(err.Error(), "exit code 7") {
+		t.Fatalf("Expected an error about the failed shutdown, but got %v", err)
+	}
+}
+
+// fakeCommitRepo provides fake Bazel binaries at commits, which fail at the commits in broken.
+type fakeCommitRepo struct {
+	broken map[string]bool
+}
+
+func (r *fakeCommitRepo) GetLastGreenCommit(bazeliskHome string) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (r *fakeCommitRepo) DownloadAtCommit(commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	exitCode := 0
+	if r.broken[commit] {
+		exitCode = 1
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(destDir, destFile)
+	return path, os.WriteFile(path, []byte(fmt.Sprintf("#!/bin/sh\nexit %d\n", exitCode)), 0755)
+}
+
+func TestBisectReturnsResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	good, middle, bad := strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)
+	compareURL := "https://api.github.com/repos/bazelbuild/bazel/compare/" + good + "..." + bad + "?page=1&per_page=250"
+	compareResponse := fmt.Sprintf(`{
+		"commits": [{"sha": %q, "parents": [{"sha": %q}]}, {"sha": %q, "parents": [{"sha": %q}]}],
+		"base_commit": {"sha": %q},
+		"merge_base_commit": {"sha": %q}
+	}`, middle, good, bad, middle, good, good)
+
+	tests := []struct {
+		name         string
+		broken       []string
+		wantFlipping string
+		wantMismatch bool
+		wantExitCode int
+	}{
+		{name: "FirstBadCommit", broken: []string{bad}, wantFlipping: bad},
+		{name: "GoodCommitIsBroken", broken: []string{good, middle, bad}, wantMismatch: true, wantExitCode: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := httputil.NewFakeTransport()
+			transport.AddResponse(compareURL, 200, compareResponse, nil)
+			previous := httputil.DefaultTransport
+			httputil.DefaultTransport = transport
+			t.Cleanup(func() { httputil.DefaultTransport = previous })
+
+			repo := &fakeCommitRepo{broken: make(map[string]bool)}
+			for _, commit := range test.broken {
+				repo.broken[commit] = true
+			}
+			repos := CreateRepositories(nil, nil, repo, nil, false)
+			result, err := bisect(context.Background(), good, bad, []string{"build"}, t.TempDir(), repos, config.Null())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.FlippingCommit != test.wantFlipping || result.OldCommitMismatch != test.wantMismatch {
+				t.Errorf("Expected flipping commit %q and mismatch %v, but got %+v", test.wantFlipping, test.wantMismatch, result)
+			}
+			if got := result.ExitCode(); got != test.wantExitCode {
+				t.Errorf("ExitCode() = %d, want %d", got, test.wantExitCode)
+			}
+		})
+	}
+}
+
+func TestRunBazeliskExecsBazel(t *testing.T) {
+	if !canExecBazel {
+		t.Skip("replacing the process is not supported on this platform")
+	}
+	if bazelPath := os.Getenv("BAZELISK_TEST_EXEC_BAZEL"); bazelPath != "" {
+		// Running in the child process started below.
+		fmt.Fprintf(os.Stderr, "bazelisk pid=%d\n", os.Getpid())
+		ExecBazel = true
+		cfg := config.Static(map[string]string{"USE_BAZEL_VERSION": bazelPath, "BAZELISK_HOME": filepath.Dir(bazelPath), ExecEnv: os.Getenv(ExecEnv)})
+		_, err := RunBazeliskWithArgsFuncAndConfig(func(string) []string { return []string{"version"} }, CreateRepositories(nil, nil, nil, nil, false), cfg)
+		t.Fatalf("Expected Bazel to replace the process, but got %v", err)
+	}
+
+	bazelPath := filepath.Join(t.TempDir(), "bazel")
+	if err := os.WriteFile(bazelPath, []byte("#!/bin/sh\necho \"bazel pid=$$\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		execEnv  string
+		wantExec bool
+	}{
+		{execEnv: "", wantExec: true},
+		{execEnv: "0", wantExec: false},
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRunBazeliskExecsBazel$")
+		cmd.Env = append(os.Environ(), "BAZELISK_TEST_EXEC_BAZEL="+bazelPath, ExecEnv+"="+tc.execEnv, skipWrapperEnv+"=1")
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil && tc.wantExec {
+			t.Fatalf("Unexpected error %v: %s", err, stderr.String())
+		}
+
+		bazeliskPid := regexp.MustCompile(`bazelisk pid=(\d+)`).FindStringSubmatch(stderr.String())
+		bazelPid := regexp.MustCompile(`bazel pid=(\d+)`).FindStringSubmatch(stdout.String())
+		if bazeliskPid == nil || bazelPid == nil {
+			t.Fatalf("%s=%q: expected both processes to print their PIDs, but got stdout %q and stderr %q", ExecEnv, tc.execEnv, stdout.String(), stderr.String())
+		}
+		if gotExec := bazeliskPid[1] == bazelPid[1]; gotExec != tc.wantExec {
+			t.Errorf("%s=%q: Bazel ran in process %s and Bazelisk in %s, want same process: %v", ExecEnv, tc.execEnv, bazelPid[1], bazeliskPid[1], tc.wantExec)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+// Exit codes for failures of Bazelisk itself. They are outside the range of exit codes that Bazel uses (including 128+N
+// for a Bazel process that was killed by signal N), so that scripts can tell a failure to get Bazel from a failed build.
+const (
+	// ExitCodeBazeliskError means that Bazelisk failed for a reason that is not covered by a more specific exit code.
+	ExitCodeBazeliskError = 200
+	// ExitCodeInvalidVersion means that the requested Bazel version could not be parsed.
+	ExitCodeInvalidVersion = 201
+	// ExitCodeResolutionFailed means that the requested Bazel version could not be resolved to an actual version.
+	ExitCodeResolutionFailed = 202
+	// ExitCodeNetworkError means that a file could not be downloaded because of a network failure, a rate limit or a server
+	// error. Such failures are often transient, so retrying may help.
+	ExitCodeNetworkError = 203
+	// ExitCodeChecksumMismatch means that a downloaded Bazel binary did not have the expected checksum.
+	ExitCodeChecksumMismatch = 204
+	// ExitCodeWrapperFailed means that the tools/bazel wrapper of the workspace could not be run.
+	ExitCodeWrapperFailed = 205
+)
+
+// VersionParseError is returned if a Bazel version (e.g. the contents of .bazelversion) cannot be parsed.
+type VersionParseError struct {
+	Version string
+	Err     error
+}
+
+func (e *VersionParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VersionParseError) Unwrap() error {
+	return e.Err
+}
+
+// ResolutionError is returned if a Bazel version cannot be resolved to an actual version, e.g. if there is no release that
+// matches "7.x" or if the list of releases cannot be fetched.
+type ResolutionError struct {
+	Fork    string
+	Version string
+	Err     error
+}
+
+func (e *ResolutionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResolutionError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumMismatchError is returned if a downloaded Bazel binary does not have the expected sha256 digest.
+type ChecksumMismatchError struct {
+	Path     string
+	Actual   string
+	Expected string
+	// Source describes where the expected digest comes from, e.g. "its published checksum". It is empty if the digest
+	// was configured via BAZELISK_VERIFY_SHA256 or the checksums file.
+	Source string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s has sha256=%s but %s is sha256=%s", e.Path, e.Actual, e.Source, e.Expected)
+	}
+	return fmt.Sprintf("%s has sha256=%s but need sha256=%s", e.Path, e.Actual, e.Expected)
+}
+
+// WrapperError is returned if the tools/bazel wrapper of the workspace cannot be started.
+type WrapperError struct {
+	Path string
+	Err  error
+}
+
+func (e *WrapperError) Error() string {
+	return fmt.Sprintf("could not run wrapper %s: %v", e.Path, e.Err)
+}
+
+func (e *WrapperError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code that Bazelisk uses for the given error returned by RunBazelisk and its variants.
+// It returns 0 for a nil error and ExitCodeBazeliskError if none of the more specific exit codes applies.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var checksumErr *ChecksumMismatchError
+	var versionErr *VersionParseError
+	var resolutionErr *ResolutionError
+	var wrapperErr *WrapperError
+	switch {
+	case errors.As(err, &checksumErr):
+		return ExitCodeChecksumMismatch
+	// Transient network failures take precedence, since they may also be the reason why a version could not be resolved.
+	case isTransientNetworkError(err):
+		return ExitCodeNetworkError
+	case errors.As(err, &versionErr):
+		return ExitCodeInvalidVersion
+	case errors.As(err, &resolutionErr):
+		return ExitCodeResolutionFailed
+	case errors.As(err, &wrapperErr):
+		return ExitCodeWrapperFailed
+	}
+	return ExitCodeBazeliskError
+}
+
+// isTransientNetworkError returns true if err was caused by a failure that retrying may fix, i.e. a transport error, a rate
+// limit or a server error. Client errors such as 404 and HTML pages (e.g. the login page of a proxy) are permanent.
+func isTransientNetworkError(err error) bool {
+	var networkErr *httputil.NetworkError
+	var statusErr *httputil.StatusError
+	var rateLimitErr *httputil.RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		return true
+	case errors.As(err, &statusErr):
+		return !isPermanentStatusCode(statusErr.StatusCode)
+	case errors.As(err, &networkErr):
+		return !isPermanentStatusCode(networkErr.StatusCode)
+	}
+	return false
+}
+
+// isPermanentStatusCode returns true for 4xx status codes, except for timeouts and rate limits.
+func isPermanentStatusCode(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+func TestExitCode(t *testing.T) {
+	networkErr := &httputil.NetworkError{URL: "https://example.com", Err: errors.New("connection reset")}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "NoError", err: nil, want: 0},
+		{name: "Other", err: errors.New("boom"), want: ExitCodeBazeliskError},
+		{name: "VersionParse", err: &VersionParseError{Version: "a/b/c", Err: errors.New("invalid")}, want: ExitCodeInvalidVersion},
+		{name: "Resolution", err: &ResolutionError{Version: "99.x", Err: errors.New("no match")}, want: ExitCodeResolutionFailed},
+		{name: "Network", err: fmt.Errorf("could not download Bazel: %w", networkErr), want: ExitCodeNetworkError},
+		{name: "NetworkDuringResolution", err: &ResolutionError{Version: "latest", Err: networkErr}, want: ExitCodeNetworkError},
+		{name: "ServerError", err: &httputil.StatusError{URL: "https://example.com", StatusCode: 503}, want: ExitCodeNetworkError},
+		{name: "NotFound", err: &httputil.StatusError{URL: "https://example.com", StatusCode: 404}, want: ExitCodeBazeliskError},
+		{name: "NotFoundDuringResolution", err: &ResolutionError{Version: "latest", Err: &httputil.NetworkError{URL: "https://example.com", StatusCode: 404, Err: errors.New("not found")}}, want: ExitCodeResolutionFailed},
+		{name: "RetriedServerError", err: &ResolutionError{Version: "latest", Err: &httputil.NetworkError{URL: "https://example.com", StatusCode: 502, Err: errors.New("bad gateway")}}, want: ExitCodeNetworkError},
+		{name: "HTMLPage", err: fmt.Errorf("wrapped: %w", &httputil.UnexpectedContentError{URL: "https://example.com", ContentType: "text/html"}), want: ExitCodeBazeliskError},
+		{name: "RateLimit", err: fmt.Errorf("wrapped: %w", &httputil.RateLimitError{URL: "https://api.github.com"}), want: ExitCodeNetworkError},
+		{name: "ChecksumMismatch", err: fmt.Errorf("wrapped: %w", &ChecksumMismatchError{Path: "bazel", Actual: "ab", Expected: "cd"}), want: ExitCodeChecksumMismatch},
+		{name: "Wrapper", err: fmt.Errorf("could not run Bazel: %w", &WrapperError{Path: "tools/bazel", Err: errors.New("exec format error")}), want: ExitCodeWrapperFailed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ExitCode(tc.err); got != tc.want {
+				t.Errorf("ExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveVersionReturnsTypedErrors(t *testing.T) {
+	repos := CreateRepositories(nil, nil, nil, nil, false)
+
+	var versionErr *VersionParseError
+	if _, _, err := repos.ResolveVersion(t.TempDir(), "", "not-a-version", config.Null()); !errors.As(err, &versionErr) {
+		t.Errorf("Expected a *VersionParseError, but got %T: %v", err, err)
+	}
+
+	var resolutionErr *ResolutionError
+	if _, _, err := repos.ResolveVersion(t.TempDir(), "", "latest", config.Null()); !errors.As(err, &resolutionErr) {
+		t.Errorf("Expected a *ResolutionError, but got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package core
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// canExecBazel is true if the Bazelisk process can be replaced with Bazel on this platform.
+const canExecBazel = false
+
+// execBazel is not supported on this platform, so Bazel always runs as a child process.
+func execBazel(cmd *exec.Cmd) error {
+	return errors.New("replacing the Bazelisk process with Bazel is not supported on this platform")
+}
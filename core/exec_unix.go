@@ -0,0 +1,20 @@
+//go:build unix
+
+package core
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// canExecBazel is true if the Bazelisk process can be replaced with Bazel on this platform.
+const canExecBazel = true
+
+// execBazel replaces the current process with the given command, keeping its PID, signal dispositions and controlling terminal.
+// It only returns if the command could not be executed.
+func execBazel(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	return syscall.Exec(cmd.Path, cmd.Args, cmd.Env)
+}
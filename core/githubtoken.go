@@ -0,0 +1,78 @@
+package core
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+// GitHubTokenEnv is the name of the environment variable that stores the GitHub access token for API requests.
+// It can also be provided by BAZELISK_GITHUB_TOKEN_COMMAND.
+const GitHubTokenEnv = "BAZELISK_GITHUB_TOKEN"
+
+// GetGitHubToken returns the GitHub access token for API requests: the value of BAZELISK_GITHUB_TOKEN, GITHUB_TOKEN or GH_TOKEN,
+// or the token that the GitHub CLI stored for github.com. It returns an empty string if there is none.
+func GetGitHubToken(config config.Config) string {
+	for _, name := range []string{GitHubTokenEnv, "GITHUB_TOKEN", "GH_TOKEN"} {
+		if token := config.Get(name); token != "" {
+			return token
+		}
+	}
+	return readGitHubCLIToken(gitHubCLIHostsFile(config), "github.com")
+}
+
+// gitHubCLIHostsFile returns the path of the hosts.yml file in which the GitHub CLI (gh) stores tokens.
+func gitHubCLIHostsFile(config config.Config) string {
+	if dir := config.Get("GH_CONFIG_DIR"); dir != "" {
+		return filepath.Join(dir, "hosts.yml")
+	}
+	if dir := config.Get("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gh", "hosts.yml")
+	}
+	if runtime.GOOS == "windows" {
+		if dir := config.Get("AppData"); dir != "" {
+			return filepath.Join(dir, "GitHub CLI", "hosts.yml")
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gh", "hosts.yml")
+}
+
+// readGitHubCLIToken returns the oauth_token of the given host in the hosts.yml file of the GitHub CLI.
+// Only the simple YAML structure that gh writes is supported. Recent versions of gh keep the token in the system keyring instead,
+// in which case BAZELISK_GITHUB_TOKEN_COMMAND="gh auth token" can be used.
+func readGitHubCLIToken(path, host string) string {
+	if path == "" {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	inHost := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
+			inHost = strings.TrimSuffix(trimmed, ":") == host
+			continue
+		}
+		if key, value, ok := strings.Cut(trimmed, ":"); inHost && ok && key == "oauth_token" {
+			return strings.Trim(strings.TrimSpace(value), `"'`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+func TestGetGitHubToken(t *testing.T) {
+	ghConfigDir := t.TempDir()
+	hosts := `github.example.com:
+    oauth_token: other
+github.com:
+    user: someone
+    oauth_token: "from-gh"
+    git_protocol: https
+`
+	if err := os.WriteFile(filepath.Join(ghConfigDir, "hosts.yml"), []byte(hosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   string
+	}{
+		{"bazelisk", map[string]string{"BAZELISK_GITHUB_TOKEN": "a", "GITHUB_TOKEN": "b", "GH_TOKEN": "c"}, "a"},
+		{"github", map[string]string{"GITHUB_TOKEN": "b", "GH_TOKEN": "c"}, "b"},
+		{"gh", map[string]string{"GH_TOKEN": "c"}, "c"},
+		{"hosts file", map[string]string{}, "from-gh"},
+		{"no hosts file", map[string]string{"GH_CONFIG_DIR": t.TempDir()}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok := tc.values["GH_CONFIG_DIR"]; !ok {
+				tc.values["GH_CONFIG_DIR"] = ghConfigDir
+			}
+			if got := GetGitHubToken(config.Static(tc.values)); got != tc.want {
+				t.Errorf("GetGitHubToken() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetGitHubTokenFromCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	counter := filepath.Join(t.TempDir(), "counter")
+	c := config.WithCommands(config.Static(map[string]string{
+		"BAZELISK_GITHUB_TOKEN_COMMAND": "echo run >> " + counter + "; echo '  secret  '",
+		"GITHUB_TOKEN":                  "fallback",
+	}))
+	for i := 0; i < 2; i++ {
+		if got := GetGitHubToken(c); got != "secret" {
+			t.Errorf("GetGitHubToken() = %q, want %q", got, "secret")
+		}
+	}
+	runs, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runs) != "run\n" {
+		t.Errorf("command ran %q, want once", runs)
+	}
+
+	failing := config.WithCommands(config.Static(map[string]string{
+		"BAZELISK_GITHUB_TOKEN_COMMAND": "exit 1",
+		"GITHUB_TOKEN":                  "fallback",
+	}))
+	if got := GetGitHubToken(failing); got != "fallback" {
+		t.Errorf("GetGitHubToken() with failing command = %q, want %q", got, "fallback")
+	}
+}
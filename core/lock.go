@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// lockPollInterval is how often a process that waits for a lock checks whether it has been released.
+	lockPollInterval = 250 * time.Millisecond
+
+	// lockHeartbeatInterval is how often the holder of a lock updates its modification time to show that it's still alive.
+	lockHeartbeatInterval = 5 * time.Second
+
+	// lockStaleAfter is how long a lock may go without a heartbeat before it is considered to belong to a crashed process.
+	lockStaleAfter = 30 * time.Second
+)
+
+// fileLock is an advisory lock between Bazelisk processes that share the same home directory.
+// It's implemented as a file that is created exclusively, which works on all platforms and file systems.
+type fileLock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// downloadLockPath returns the path of the lock that guards the download of the given metadata entry.
+func downloadLockPath(bazeliskHome, bazelForkOrURLDirName, pathSegment string) string {
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(bazelForkOrURLDirName+"/"+pathSegment)))
+	return filepath.Join(bazeliskHome, "downloads", "_locks", key+".lock")
+}
+
+// acquireLock blocks until it holds the lock at path, or until the context is done. Locks of processes that stopped sending heartbeats are broken.
+func acquireLock(ctx context.Context, path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory for lock %s: %v", path, err)
+	}
+
+	waiting := false
+	for {
+		l, err := createLock(path)
+		if err == nil {
+			return l, nil
+		} else if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not create lock %s: %v", path, err)
+		}
+
+		if stat, err := os.Stat(path); err == nil && time.Since(stat.ModTime()) > lockStaleAfter {
+			holder, _ := os.ReadFile(path)
+			log.Printf("Breaking stale lock %s (held by %s)", path, holder)
+			// Only remove the lock if nobody else has broken (and re-acquired) it in the meantime.
+			if current, err := os.Stat(path); err == nil && os.SameFile(stat, current) && current.ModTime().Equal(stat.ModTime()) {
+				os.Remove(path)
+			}
+			continue
+		}
+
+		if !waiting {
+			log.Printf("Waiting for another Bazelisk process to finish downloading...")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped waiting for lock %s: %w", path, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryAcquireLock acquires the lock at path if nobody holds it. Unlike acquireLock it doesn't wait, but returns nil if another process holds the lock.
+func tryAcquireLock(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create directory for lock %s: %v", path, err)
+	}
+	l, err := createLock(path)
+	if os.IsExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not create lock %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// createLock creates the lock file at path, which must not exist yet, and starts sending heartbeats.
+func createLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(f, "pid=%d host=%s\n", os.Getpid(), hostname)
+	f.Close()
+
+	l := &fileLock{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go l.heartbeat()
+	return l, nil
+}
+
+func (l *fileLock) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// release releases the lock. It must only be called once.
+func (l *fileLock) release() {
+	close(l.stop)
+	<-l.done
+	os.Remove(l.path)
+}
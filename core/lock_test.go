@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestConcurrentDownloadsFetchBinaryOnce(t *testing.T) {
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, true, config.Null())
+	if err != nil {
+		t.Fatalf("Could not determine Bazel filename: %v", err)
+	}
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+fakeBazelVersion+"/"+filename {
+			http.NotFound(w, r)
+			return
+		}
+		downloads.Add(1)
+		// Give the other processes a chance to start their downloads, too.
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(fakeBazelScript("shared bazel")))
+	}))
+	t.Cleanup(server.Close)
+	bazeliskHome := t.TempDir()
+
+	var wg sync.WaitGroup
+	paths := make([]string, 8)
+	errs := make([]error, len(paths))
+	for i := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths[i], errs[i] = downloadFakeBazel(t, bazeliskHome, map[string]string{BaseURLEnv: server.URL})
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if paths[i] != paths[0] {
+			t.Fatalf("Expected all downloads to return %s, but got %s", paths[0], paths[i])
+		}
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Fatalf("Expected the binary to be downloaded once, but it was downloaded %d times", n)
+	}
+}
+
+func TestAcquireLockBreaksStaleLock(t *testing.T) {
+	path := downloadLockPath(t.TempDir(), "fake", "bazel-7.4.1-linux-x86_64")
+	held, err := acquireLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Simulate a crashed holder that stopped sending heartbeats.
+	close(held.stop)
+	<-held.done
+	stale := time.Now().Add(-2 * lockStaleAfter)
+	if err := os.Chtimes(path, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *fileLock)
+	go func() {
+		lock, err := acquireLock(context.Background(), path)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		acquired <- lock
+	}()
+
+	select {
+	case lock := <-acquired:
+		lock.release()
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the stale lock to be broken")
+	}
+}
+
+func TestAcquireLockStopsWaitingWhenCancelled(t *testing.T) {
+	path := downloadLockPath(t.TempDir(), "fake", "bazel-7.4.1-linux-x86_64")
+	held, err := acquireLock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer held.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := acquireLock(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected acquireLock to give up once the context is done, but got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the lock of the other process to be kept, but got %v", err)
+	}
+}
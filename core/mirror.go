@@ -0,0 +1,211 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+const defaultMirrorAddress = "localhost:8080"
+
+// mirrorHandler serves the Bazel binaries in the cache over HTTP, both in the layout that BAZELISK_BASE_URL expects
+// (/[version]/[file]) and in the layout of releases.bazel.build (/[version]/release/[file], /[version]/rc[n]/[file] and
+// /[version]/rolling/[version]/[file]). Binaries that are not cached yet are downloaded from upstream first.
+// Moreover, it lists the cached binaries like the JSON API of Google Cloud Storage (/storage/v1/b/[bucket]/o).
+type mirrorHandler struct {
+	bazeliskHome string
+	repos        *Repositories
+	config       config.Config
+}
+
+func newMirrorHandler(bazeliskHome string, repos *Repositories, config config.Config) http.Handler {
+	return &mirrorHandler{bazeliskHome: bazeliskHome, repos: repos, config: config}
+}
+
+func (h *mirrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && strings.HasSuffix(r.URL.Path, "/o") {
+		h.serveListing(w, r)
+		return
+	}
+	h.serveFile(w, r)
+}
+
+// releasesDir returns the directory of the given version on releases.bazel.build.
+func releasesDir(version string) string {
+	if strings.Contains(version, "rc") {
+		baseVersion, candidate, _ := strings.Cut(version, "rc")
+		return baseVersion + "/rc" + candidate
+	}
+	if baseVersion, _, ok := strings.Cut(version, "-"); ok {
+		return baseVersion + "/rolling/" + version
+	}
+	return version + "/release"
+}
+
+// parseMirrorPath returns the version, platform and flavor of the Bazel binary at the given URL path.
+func parseMirrorPath(urlPath string) (version string, platform platforms.Platform, flavor string, ok bool) {
+	dir, filename := path.Split(strings.TrimPrefix(urlPath, "/"))
+	flavor, version, platformName, ok := parseMetadataName(strings.TrimSuffix(filename, ".exe"))
+	if !ok || (flavor != "bazel" && flavor != "bazel_nojdk") {
+		return "", platforms.Platform{}, "", false
+	}
+	platform, err := platforms.ParsePlatform(platformName)
+	if err != nil || platform.String() != platformName || filename != strings.TrimSuffix(filename, ".exe")+platform.ExecutableFilenameSuffix() {
+		return "", platforms.Platform{}, "", false
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir != version && dir != releasesDir(version) {
+		return "", platforms.Platform{}, "", false
+	}
+	return version, platform, flavor, true
+}
+
+func (h *mirrorHandler) serveFile(w http.ResponseWriter, r *http.Request) {
+	urlPath, isChecksum := strings.CutSuffix(r.URL.Path, ".sha256")
+	version, platform, flavor, ok := parseMirrorPath(urlPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	nojdk := "0"
+	if flavor == "bazel_nojdk" {
+		nojdk = "1"
+	}
+	flavorConfig := config.Layered(config.Static(map[string]string{"BAZELISK_NOJDK": nojdk}), h.config)
+
+	// Exact versions resolve without contacting upstream, so cached binaries can be served offline.
+	resolvedVersion, downloader, err := h.repos.ResolveVersionContext(r.Context(), h.bazeliskHome, versions.BazelUpstream, version, flavorConfig)
+	if err != nil || resolvedVersion != version {
+		http.NotFound(w, r)
+		return
+	}
+	pathToBazelInCAS, err := downloadBazelIfNecessary(r.Context(), version, platform, h.bazeliskHome, versions.BazelUpstream, dirForForkOrURL(versions.BazelUpstream, flavorConfig), h.repos, flavorConfig, downloader)
+	if err != nil {
+		log.Printf("Could not serve %s: %v", r.URL.Path, err)
+		http.Error(w, fmt.Sprintf("could not download %s from upstream", path.Base(urlPath)), http.StatusBadGateway)
+		return
+	}
+
+	if isChecksum {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s  %s\n", digestFromCASPath(pathToBazelInCAS), path.Base(urlPath))
+		return
+	}
+
+	f, err := os.Open(pathToBazelInCAS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// ServeContent supports range requests, which lets clients resume interrupted downloads.
+	http.ServeContent(w, r, path.Base(urlPath), stat.ModTime(), f)
+}
+
+// gcsObject is the subset of a Google Cloud Storage object resource that the listing contains.
+type gcsObject struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+// serveListing lists the cached binaries in the releases.bazel.build layout, like
+// https://www.googleapis.com/storage/v1/b/bazel/o?delimiter=/&prefix=[prefix] does for the official releases.
+func (h *mirrorHandler) serveListing(w http.ResponseWriter, r *http.Request) {
+	entries, err := readCacheEntries(h.bazeliskHome)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	forkDir := dirForForkOrURL(versions.BazelUpstream, h.config) + "/"
+	prefixes := make(map[string]bool)
+	items := []gcsObject{}
+	for _, entry := range entries {
+		for _, name := range entry.names {
+			metadataName, ok := strings.CutPrefix(name, forkDir)
+			if !ok {
+				continue
+			}
+			_, version, platformName, ok := parseMetadataName(metadataName)
+			if !ok {
+				continue
+			}
+			platform, err := platforms.ParsePlatform(platformName)
+			if err != nil {
+				continue
+			}
+			object := releasesDir(version) + "/" + metadataName + platform.ExecutableFilenameSuffix()
+			rest, ok := strings.CutPrefix(object, prefix)
+			if !ok {
+				continue
+			}
+			if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+				prefixes[prefix+rest[:i+len(delimiter)]] = true
+			} else {
+				items = append(items, gcsObject{Name: object, Size: fmt.Sprint(entry.size)})
+			}
+		}
+	}
+
+	response := struct {
+		Kind     string      `json:"kind"`
+		Prefixes []string    `json:"prefixes,omitempty"`
+		Items    []gcsObject `json:"items,omitempty"`
+	}{Kind: "storage#objects", Items: items}
+	for p := range prefixes {
+		response.Prefixes = append(response.Prefixes, p)
+	}
+	sort.Strings(response.Prefixes)
+	sort.Slice(response.Items, func(i, j int) bool { return response.Items[i].Name < response.Items[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Could not write listing: %v", err)
+	}
+}
+
+// serveMirror runs --serve[=<address>], which serves the cache over HTTP until the process is terminated or the context is done.
+func serveMirror(ctx context.Context, command string, bazeliskHome string, repos *Repositories, config config.Config) (int, error) {
+	address := defaultMirrorAddress
+	if _, value, ok := strings.Cut(command, "="); ok {
+		address = value
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return -1, fmt.Errorf("could not listen on %s: %v", address, err)
+	}
+	log.Printf("Serving Bazel binaries from %s on http://%s, set %s=http://%s to use them", bazeliskHome, listener.Addr(), BaseURLEnv, listener.Addr())
+	server := &http.Server{Handler: newMirrorHandler(bazeliskHome, repos, config)}
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return -1, fmt.Errorf("could not serve Bazel binaries: %v", err)
+	}
+	return 0, nil
+}
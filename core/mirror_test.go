@@ -0,0 +1,117 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func getFromMirror(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Could not get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read %s: %v", url, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMirrorFetchesThroughAndServesFromCache(t *testing.T) {
+	binary := fakeBazelScript("mirrored")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, true, config.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+fakeBazelVersion+"/"+filename {
+			http.NotFound(w, r)
+			return
+		}
+		upstreamRequests++
+		w.Write([]byte(binary))
+	}))
+	t.Cleanup(upstream.Close)
+
+	repos := CreateRepositories(nil, nil, nil, nil, true)
+	mirror := httptest.NewServer(newMirrorHandler(t.TempDir(), repos, config.Static(map[string]string{BaseURLEnv: upstream.URL})))
+	t.Cleanup(mirror.Close)
+
+	for _, path := range []string{"/" + fakeBazelVersion + "/release/" + filename, "/" + fakeBazelVersion + "/" + filename} {
+		if status, body := getFromMirror(t, mirror.URL+path); status != http.StatusOK || body != binary {
+			t.Fatalf("Expected %s to serve the binary, but got %d: %q", path, status, body)
+		}
+	}
+	if upstreamRequests != 1 {
+		t.Fatalf("Expected the binary to be fetched from upstream once, but it was fetched %d times", upstreamRequests)
+	}
+	if status, body := getFromMirror(t, mirror.URL+"/"+fakeBazelVersion+"/"+filename+".sha256"); status != http.StatusOK || !strings.HasPrefix(body, digest+"  "+filename) {
+		t.Fatalf("Expected the checksum of the binary, but got %d: %q", status, body)
+	}
+	if status, _ := getFromMirror(t, mirror.URL+"/6.5.0/"+filename); status != http.StatusNotFound {
+		t.Fatalf("Expected a binary in the wrong directory not to be found, but got %d", status)
+	}
+
+	// Clients that use the mirror as BAZELISK_BASE_URL get the same binary.
+	path, err := downloadFakeBazel(t, t.TempDir(), map[string]string{BaseURLEnv: mirror.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if digestFromCASPath(path) != digest {
+		t.Fatalf("Expected the mirrored binary with digest %s, but got %s", digest, path)
+	}
+}
+
+func TestMirrorListsCachedBinaries(t *testing.T) {
+	bazeliskHome := t.TempDir()
+	addCacheEntry(t, bazeliskHome, "bazel-7.4.1-linux-x86_64", "linux", time.Now())
+	addCacheEntry(t, bazeliskHome, "bazel-7.4.1-windows-x86_64", "windows", time.Now())
+	addCacheEntry(t, bazeliskHome, "bazel-8.0.0rc1-linux-x86_64", "rc", time.Now())
+
+	repos := CreateRepositories(nil, nil, nil, nil, true)
+	mirror := httptest.NewServer(newMirrorHandler(bazeliskHome, repos, config.Null()))
+	t.Cleanup(mirror.Close)
+
+	tests := []struct {
+		prefix       string
+		wantPrefixes []string
+		wantItems    []string
+	}{
+		{prefix: "", wantPrefixes: []string{"7.4.1/", "8.0.0/"}},
+		{prefix: "8.0.0/", wantPrefixes: []string{"8.0.0/rc1/"}},
+		{prefix: "7.4.1/release/", wantItems: []string{"7.4.1/release/bazel-7.4.1-linux-x86_64", "7.4.1/release/bazel-7.4.1-windows-x86_64.exe"}},
+	}
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			status, body := getFromMirror(t, mirror.URL+"/storage/v1/b/bazel/o?delimiter=/&prefix="+test.prefix)
+			var listing struct {
+				Prefixes []string
+				Items    []gcsObject
+			}
+			if err := json.Unmarshal([]byte(body), &listing); err != nil || status != http.StatusOK {
+				t.Fatalf("Expected a JSON listing, but got %d: %q (%v)", status, body, err)
+			}
+			var items []string
+			for _, item := range listing.Items {
+				items = append(items, item.Name)
+			}
+			if fmt.Sprint(listing.Prefixes) != fmt.Sprint(test.wantPrefixes) || fmt.Sprint(items) != fmt.Sprint(test.wantItems) {
+				t.Fatalf("Expected prefixes %v and items %v, but got %q", test.wantPrefixes, test.wantItems, body)
+			}
+		})
+	}
+}
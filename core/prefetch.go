@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+// parseVersionsAndPlatforms parses the arguments of --prefetch and --update_checksums, i.e. an optional
+// "--platforms=linux-x86_64,darwin-arm64" and a list of versions. It defaults to the current platform and the version of the current workspace.
+func parseVersionsAndPlatforms(command string, args []string, config config.Config) ([]string, []platforms.Platform, error) {
+	var bazelVersions []string
+	var targetPlatforms []platforms.Platform
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			bazelVersions = append(bazelVersions, arg)
+			continue
+		}
+		value, ok := strings.CutPrefix(arg, "--platforms=")
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown option %q for %s, expected --platforms=<os-arch,...> or versions", arg, command)
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			platform, err := platforms.ParsePlatform(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			targetPlatforms = append(targetPlatforms, platform)
+		}
+	}
+
+	if len(bazelVersions) == 0 {
+		bazelVersion, err := GetBazelVersion(config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not get Bazel version: %v", err)
+		}
+		bazelVersions = []string{bazelVersion}
+	}
+	if len(targetPlatforms) == 0 {
+		platform, err := platforms.CurrentPlatform()
+		if err != nil {
+			return nil, nil, err
+		}
+		targetPlatforms = []platforms.Platform{platform}
+	}
+	return bazelVersions, targetPlatforms, nil
+}
+
+// downloadBazelForPlatforms resolves the given Bazel version once and downloads it for each of the given platforms.
+// It returns the resolved version and the paths of the binaries in the same order as the platforms.
+func downloadBazelForPlatforms(ctx context.Context, bazelVersionString string, targetPlatforms []platforms.Platform, bazeliskHome string, repos *Repositories, config config.Config) (string, []string, error) {
+	bazelFork, bazelVersion, err := parseBazelForkAndVersion(bazelVersionString)
+	if err != nil {
+		return "", nil, &VersionParseError{Version: bazelVersionString, Err: fmt.Errorf("could not parse Bazel fork and version: %v", err)}
+	}
+
+	// Resolving the version only once ensures that "latest" refers to the same release on every platform.
+	resolvedBazelVersion, downloader, err := repos.ResolveVersionContext(ctx, bazeliskHome, bazelFork, bazelVersion, config)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not resolve the version '%s' to an actual version number: %w", bazelVersion, err)
+	}
+
+	var bazelPaths []string
+	for _, platform := range targetPlatforms {
+		bazelPath, err := downloadBazelIfNecessary(ctx, resolvedBazelVersion, platform, bazeliskHome, bazelFork, dirForForkOrURL(bazelFork, config), repos, config, downloader)
+		if err != nil {
+			return "", nil, fmt.Errorf("could not download Bazel %s for %s: %w", bazelVersionString, platform, err)
+		}
+		bazelPaths = append(bazelPaths, bazelPath)
+	}
+	return resolvedBazelVersion, bazelPaths, nil
+}
+
+// prefetch runs --prefetch, which downloads the given Bazel versions for the given platforms into the cache without running them,
+// e.g. to populate a shared cache or a bundle for machines with a different operating system.
+func prefetch(ctx context.Context, args []string, bazeliskHome string, repos *Repositories, config config.Config, out io.Writer) (int, error) {
+	if out == nil {
+		out = os.Stdout
+	}
+	bazelVersions, targetPlatforms, err := parseVersionsAndPlatforms("--prefetch", args, config)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, bazelVersionString := range bazelVersions {
+		resolvedBazelVersion, bazelPaths, err := downloadBazelForPlatforms(ctx, bazelVersionString, targetPlatforms, bazeliskHome, repos, config)
+		if err != nil {
+			return -1, err
+		}
+		for i, platform := range targetPlatforms {
+			bazelFilename, err := platforms.DetermineBazelFilenameForPlatform(resolvedBazelVersion, platform, false, config)
+			if err != nil {
+				return -1, err
+			}
+			fmt.Fprintf(out, "%s  %s\n", digestFromCASPath(bazelPaths[i]), bazelFilename)
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+func TestPrefetchForOtherPlatforms(t *testing.T) {
+	binaries := map[string]string{
+		"bazel-" + fakeBazelVersion + "-linux-arm64":        fakeBazelScript("linux"),
+		"bazel-" + fakeBazelVersion + "-windows-x86_64.exe": fakeBazelScript("windows"),
+	}
+	mux := http.NewServeMux()
+	for filename, binary := range binaries {
+		mux.HandleFunc("/"+fakeBazelVersion+"/"+filename, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(binary))
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	bazeliskHome := t.TempDir()
+	config := config.Static(map[string]string{BaseURLEnv: server.URL})
+	repos := CreateRepositories(nil, nil, nil, nil, true)
+	var out bytes.Buffer
+	if _, err := prefetch(context.Background(), []string{"--platforms=linux-aarch64,windows-x86_64", fakeBazelVersion}, bazeliskHome, repos, config, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for filename, binary := range binaries {
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+		name := strings.TrimSuffix(filename, ".exe")
+		mapping, err := os.ReadFile(filepath.Join(bazeliskHome, "downloads", "metadata", dirForURL(server.URL), name))
+		if err != nil || string(mapping) != digest {
+			t.Errorf("Expected %s to refer to %s, but got %q (%v)", name, digest, mapping, err)
+		}
+		if !strings.Contains(out.String(), digest+"  "+name) {
+			t.Errorf("Expected %s to be reported, but got:\n%s", name, out.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", fmt.Sprintf("%x", sha256.Sum256([]byte(binaries["bazel-"+fakeBazelVersion+"-windows-x86_64.exe"]))), "bin", "bazel.exe")); err != nil {
+		t.Errorf("Expected the Windows binary to keep its extension: %v", err)
+	}
+}
+
+func TestParseVersionsAndPlatforms(t *testing.T) {
+	versions, targetPlatforms, err := parseVersionsAndPlatforms("--prefetch", []string{"--platforms=darwin-arm64, linux-x86_64", "7.4.1", "8.0.0"}, config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []platforms.Platform{{OS: "darwin", Arch: "arm64"}, {OS: "linux", Arch: "x86_64"}}
+	if strings.Join(versions, ",") != "7.4.1,8.0.0" || len(targetPlatforms) != 2 || targetPlatforms[0] != want[0] || targetPlatforms[1] != want[1] {
+		t.Fatalf("Expected %v for %v, but got %v for %v", []string{"7.4.1", "8.0.0"}, want, versions, targetPlatforms)
+	}
+
+	if _, _, err := parseVersionsAndPlatforms("--prefetch", []string{"--platforms=beos-x86_64"}, config.Null()); err == nil {
+		t.Fatalf("Expected an error for an unsupported platform")
+	}
+}
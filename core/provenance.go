@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+const (
+	// VerifyProvenanceEnv is the name of the environment variable that enables the verification of in-toto/SLSA provenance attestations of Bazel binaries.
+	VerifyProvenanceEnv = "BAZELISK_VERIFY_PROVENANCE"
+
+	// ProvenanceSuffixEnv is the name of the environment variable that stores the suffix that is appended to the URL of a Bazel binary to get its provenance attestation.
+	ProvenanceSuffixEnv = "BAZELISK_PROVENANCE_SUFFIX"
+
+	// ProvenanceTrustRootsEnv is the name of the environment variable that stores the paths of PEM files with the public keys (or certificates) that may sign provenance attestations.
+	// Multiple paths are separated by the OS-specific path list separator.
+	ProvenanceTrustRootsEnv = "BAZELISK_PROVENANCE_TRUST_ROOTS"
+
+	// ProvenanceBuildersEnv is the name of the environment variable that stores the comma-separated list of builder IDs that are allowed to build Bazel binaries.
+	ProvenanceBuildersEnv = "BAZELISK_PROVENANCE_BUILDERS"
+
+	defaultProvenanceSuffix = ".intoto.jsonl"
+	provenanceRecordSuffix  = ".provenance.json"
+	dssePayloadType         = "application/vnd.in-toto+json"
+)
+
+// dsseEnvelope is a signed attestation, see https://github.com/secure-systems-lab/dsse.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement contains the parts of an in-toto statement with a SLSA provenance predicate (v0.2 or v1) that Bazelisk checks.
+type inTotoStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string `json:"predicateType"`
+	Predicate     struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+func (s *inTotoStatement) builderID() string {
+	if id := s.Predicate.RunDetails.Builder.ID; id != "" {
+		return id
+	}
+	return s.Predicate.Builder.ID
+}
+
+// provenanceRecord describes a successfully verified provenance attestation. It is stored next to the metadata entry of a Bazel binary.
+type provenanceRecord struct {
+	Sha256        string `json:"sha256"`
+	PredicateType string `json:"predicateType"`
+	BuilderID     string `json:"builderId"`
+	KeyID         string `json:"keyId,omitempty"`
+}
+
+func isProvenanceVerificationEnabled(config config.Config) bool {
+	switch strings.ToLower(config.Get(VerifyProvenanceEnv)) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+func getProvenanceSuffix(config config.Config) string {
+	if suffix := config.Get(ProvenanceSuffixEnv); suffix != "" {
+		return suffix
+	}
+	return defaultProvenanceSuffix
+}
+
+// getProvenanceTrustRoots reads all public keys from the configured PEM files.
+func getProvenanceTrustRoots(config config.Config) ([]crypto.PublicKey, error) {
+	paths := config.Get(ProvenanceTrustRootsEnv)
+	if paths == "" {
+		return nil, fmt.Errorf("cannot verify provenance since %s is not set", ProvenanceTrustRootsEnv)
+	}
+
+	var keys []crypto.PublicKey
+	for _, path := range filepath.SplitList(paths) {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read trust root %s: %v", path, err)
+		}
+		for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("could not parse public key in %s: %v", path, err)
+				}
+				keys = append(keys, key)
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("could not parse certificate in %s: %v", path, err)
+				}
+				keys = append(keys, cert.PublicKey)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", paths)
+	}
+	return keys, nil
+}
+
+// verifyProvenance checks that the attestation file at attestationPath contains a statement about a binary with the given digest,
+// signed by one of the configured trust roots and built by one of the allowed builders.
+func verifyProvenance(attestationPath, actualSha256 string, config config.Config) (*provenanceRecord, error) {
+	keys, err := getProvenanceTrustRoots(config)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedBuilders := make(map[string]bool)
+	for _, builder := range strings.Split(config.Get(ProvenanceBuildersEnv), ",") {
+		if builder = strings.TrimSpace(builder); builder != "" {
+			allowedBuilders[builder] = true
+		}
+	}
+	if len(allowedBuilders) == 0 {
+		return nil, fmt.Errorf("cannot verify provenance since %s is not set", ProvenanceBuildersEnv)
+	}
+
+	f, err := os.Open(attestationPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open provenance attestation %s: %v", attestationPath, err)
+	}
+	defer f.Close()
+
+	// The file contains one DSSE envelope per line. One of them has to match.
+	var problems []error
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record, err := verifyEnvelope(line, actualSha256, keys, allowedBuilders)
+		if err == nil {
+			return record, nil
+		}
+		problems = append(problems, err)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read provenance attestation %s: %v", attestationPath, err)
+	}
+	if len(problems) == 0 {
+		return nil, errors.New("provenance attestation of downloaded Bazel binary is empty")
+	}
+	return nil, fmt.Errorf("could not verify provenance of downloaded Bazel binary: %v", errors.Join(problems...))
+}
+
+func verifyEnvelope(line []byte, actualSha256 string, keys []crypto.PublicKey, allowedBuilders map[string]bool) (*provenanceRecord, error) {
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid DSSE envelope: %v", err)
+	}
+	if envelope.PayloadType != dssePayloadType {
+		return nil, fmt.Errorf("unexpected payload type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encoding: %v", err)
+	}
+
+	keyID, err := verifyEnvelopeSignatures(&envelope, payload, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return nil, fmt.Errorf("invalid in-toto statement: %v", err)
+	}
+
+	found := false
+	for _, subject := range statement.Subject {
+		if strings.ToLower(subject.Digest["sha256"]) == actualSha256 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no subject with sha256=%s", actualSha256)
+	}
+
+	builder := statement.builderID()
+	if !allowedBuilders[builder] {
+		return nil, fmt.Errorf("builder %q is not in %s", builder, ProvenanceBuildersEnv)
+	}
+
+	return &provenanceRecord{
+		Sha256:        actualSha256,
+		PredicateType: statement.PredicateType,
+		BuilderID:     builder,
+		KeyID:         keyID,
+	}, nil
+}
+
+// verifyEnvelopeSignatures returns the key ID of the first signature of the envelope that was created by one of the given keys.
+func verifyEnvelopeSignatures(envelope *dsseEnvelope, payload []byte, keys []crypto.PublicKey) (string, error) {
+	// DSSE signs the "pre-authentication encoding" of the payload, not the payload itself.
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(envelope.PayloadType), envelope.PayloadType, len(payload), payload))
+	for _, signature := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if verifyRawSignature(key, pae, sig) {
+				return signature.KeyID, nil
+			}
+		}
+	}
+	return "", errors.New("no valid signature from a trusted key")
+}
+
+func verifyRawSignature(key crypto.PublicKey, message, sig []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, message, sig)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch k.Curve {
+		case elliptic.P384():
+			sum := sha512.Sum384(message)
+			digest = sum[:]
+		case elliptic.P521():
+			sum := sha512.Sum512(message)
+			digest = sum[:]
+		default:
+			sum := sha256.Sum256(message)
+			digest = sum[:]
+		}
+		return ecdsa.VerifyASN1(k, digest, sig)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil
+	}
+	return false
+}
+
+// writeProvenanceRecord stores the result of a successful provenance verification next to the given metadata entry.
+func writeProvenanceRecord(mappingPath string, record *provenanceRecord) error {
+	contents, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(mappingPath+provenanceRecordSuffix, contents, 0644)
+}
+
+// hasProvenanceRecord returns whether the provenance of the binary referenced by the given metadata entry has been verified.
+func hasProvenanceRecord(mappingPath, digest string) bool {
+	contents, err := os.ReadFile(mappingPath + provenanceRecordSuffix)
+	if err != nil {
+		return false
+	}
+	var record provenanceRecord
+	return json.Unmarshal(contents, &record) == nil && record.Sha256 == digest
+}
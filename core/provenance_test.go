@@ -0,0 +1,127 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const trustedBuilder = "https://github.com/bazelbuild/bazel/.github/workflows/release.yml"
+
+func newTrustRoot(t *testing.T) (ed25519.PrivateKey, string) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("Could not marshal public key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "trust_root.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Could not write trust root: %v", err)
+	}
+	return private, path
+}
+
+func attest(t *testing.T, key ed25519.PrivateKey, digest, builder string) string {
+	statement := fmt.Sprintf(`{
+		"_type": "https://in-toto.io/Statement/v1",
+		"subject": [{"name": "bazel", "digest": {"sha256": %q}}],
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": {"runDetails": {"builder": {"id": %q}}}
+	}`, digest, builder)
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(dssePayloadType), dssePayloadType, len(statement), statement)
+	envelope := map[string]interface{}{
+		"payloadType": dssePayloadType,
+		"payload":     base64.StdEncoding.EncodeToString([]byte(statement)),
+		"signatures": []map[string]string{
+			{"keyid": "test", "sig": base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(pae)))},
+		},
+	}
+	line, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Could not marshal envelope: %v", err)
+	}
+	return string(line) + "\n"
+}
+
+func TestDownloadVerifiesProvenance(t *testing.T) {
+	key, trustRoot := newTrustRoot(t)
+	binary := fakeBazelScript("bazel with provenance")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	baseURL := serveFakeBazel(t, binary, map[string]string{".intoto.jsonl": attest(t, key, digest, trustedBuilder)})
+	bazeliskHome := t.TempDir()
+
+	_, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:              baseURL,
+		VerifyProvenanceEnv:     "1",
+		ProvenanceTrustRootsEnv: trustRoot,
+		ProvenanceBuildersEnv:   "https://example.com/other-builder," + trustedBuilder,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	records, _ := filepath.Glob(filepath.Join(bazeliskHome, "downloads", "metadata", "fake", "*"+provenanceRecordSuffix))
+	if len(records) != 1 {
+		t.Fatalf("Expected the provenance to be recorded in the metadata, but found %d records", len(records))
+	}
+	contents, _ := os.ReadFile(records[0])
+	if !strings.Contains(string(contents), trustedBuilder) {
+		t.Fatalf("Expected the provenance record to contain the builder ID, but got %s", contents)
+	}
+}
+
+func TestDownloadRejectsProvenance(t *testing.T) {
+	key, trustRoot := newTrustRoot(t)
+	untrustedKey, _ := newTrustRoot(t)
+	binary := fakeBazelScript("bazel with provenance")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+
+	tests := []struct {
+		name        string
+		attestation string
+		wantErr     string
+	}{
+		{
+			name:        "UntrustedBuilder",
+			attestation: attest(t, key, digest, "https://example.com/evil-builder"),
+			wantErr:     "is not in " + ProvenanceBuildersEnv,
+		},
+		{
+			name:        "WrongDigest",
+			attestation: attest(t, key, strings.Repeat("0", 64), trustedBuilder),
+			wantErr:     "no subject with sha256=" + digest,
+		},
+		{
+			name:        "UntrustedKey",
+			attestation: attest(t, untrustedKey, digest, trustedBuilder),
+			wantErr:     "no valid signature from a trusted key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseURL := serveFakeBazel(t, binary, map[string]string{".intoto.jsonl": test.attestation})
+			_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+				BaseURLEnv:              baseURL,
+				VerifyProvenanceEnv:     "1",
+				ProvenanceTrustRootsEnv: trustRoot,
+				ProvenanceBuildersEnv:   trustedBuilder,
+			})
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Expected error containing %q, but got %v", test.wantErr, err)
+			}
+		})
+	}
+}
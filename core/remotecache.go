@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+const (
+	// RemoteCacheEnv is the name of the environment variable that stores the URL of a Bazel remote cache with the HTTP protocol
+	// (e.g. bazel-remote), which Bazelisk uses to share downloaded binaries by their sha256 digest.
+	RemoteCacheEnv = "BAZELISK_REMOTE_CACHE"
+)
+
+// getRemoteCache returns the base URL of the remote cache without a trailing slash, or an empty string if none is configured.
+func getRemoteCache(config config.Config) (string, error) {
+	remoteCache := strings.TrimSuffix(config.Get(RemoteCacheEnv), "/")
+	if remoteCache != "" && !strings.HasPrefix(remoteCache, "http://") && !strings.HasPrefix(remoteCache, "https://") {
+		return "", fmt.Errorf("%s must be an http:// or https:// URL of a remote cache that supports the HTTP caching protocol, but got %q", RemoteCacheEnv, remoteCache)
+	}
+	return remoteCache, nil
+}
+
+// knownDigest returns the sha256 digest that the binary at mappingPath must have, if it is known without downloading the binary:
+// either because it is pinned, or because the binary was downloaded before (and has since been removed from the cache).
+func knownDigest(mappingPath, expectedSha256 string) string {
+	if expectedSha256 != "" {
+		return expectedSha256
+	}
+	digest, err := os.ReadFile(mappingPath)
+	if err != nil || !sha256Pattern.Match(digest) {
+		return ""
+	}
+	return string(digest)
+}
+
+// fetchFromRemoteCache downloads the Bazel binary with the given digest from /cas/[sha256] of the remote cache into the CAS
+// and returns its path. It returns an empty path if the remote cache does not have the binary.
+func fetchFromRemoteCache(ctx context.Context, remoteCache, digest string, platform platforms.Platform, bazeliskHome string, config config.Config) (string, error) {
+	tmpDestFileBytes := make([]byte, 32)
+	if _, err := rand.Read(tmpDestFileBytes); err != nil {
+		return "", fmt.Errorf("failed to generate temporary file name: %w", err)
+	}
+	tmpDestPath, err := httputil.DownloadBinaryContext(ctx, remoteCache+"/cas/"+digest, filepath.Join(bazeliskHome, "downloads", "_tmp"), fmt.Sprintf("%x", tmpDestFileBytes), config)
+	if err != nil {
+		var statusErr *httputil.StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if err := validateBinary(tmpDestPath, remoteCache+"/cas/"+digest); err != nil {
+		os.Remove(tmpDestPath)
+		return "", err
+	}
+	actualSha256, err := sha256OfFile(tmpDestPath)
+	if err != nil {
+		os.Remove(tmpDestPath)
+		return "", err
+	}
+	if actualSha256 != digest {
+		os.Remove(tmpDestPath)
+		return "", fmt.Errorf("remote cache returned a file with sha256=%s for sha256=%s", actualSha256, digest)
+	}
+	if err := smokeTestBinary(tmpDestPath, remoteCache+"/cas/"+digest, platform, config); err != nil {
+		os.Remove(tmpDestPath)
+		return "", err
+	}
+	return moveIntoCAS(tmpDestPath, digest, platform, bazeliskHome)
+}
+
+// uploadToRemoteCache stores the given Bazel binary at /cas/[sha256] of the remote cache. Failures are only logged,
+// since the binary is already available locally.
+func uploadToRemoteCache(ctx context.Context, remoteCache, pathToBazelInCAS, digest string) {
+	if err := httputil.UploadFileContext(ctx, remoteCache+"/cas/"+digest, pathToBazelInCAS); err != nil {
+		log.Printf("Warning: could not upload Bazel binary to remote cache: %v", err)
+	}
+}
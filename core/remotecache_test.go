@@ -0,0 +1,158 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+// fakeRemoteCache implements the /cas/[sha256] part of the HTTP caching protocol of Bazel remote caches.
+type fakeRemoteCache struct {
+	mu    sync.Mutex
+	blobs map[string]string
+}
+
+func (c *fakeRemoteCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	digest, ok := strings.CutPrefix(r.URL.Path, "/cas/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		blob, ok := c.blobs[digest]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(blob))
+	case http.MethodPut:
+		blob, _ := io.ReadAll(r.Body)
+		c.blobs[digest] = string(blob)
+	}
+}
+
+func serveFakeRemoteCache(t *testing.T, blobs map[string]string) string {
+	server := httptest.NewServer(&fakeRemoteCache{blobs: blobs})
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestDownloadUploadsToRemoteCache(t *testing.T) {
+	binary := fakeBazelScript("uploaded")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	blobs := make(map[string]string)
+
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:     serveFakeBazel(t, binary, nil),
+		RemoteCacheEnv: serveFakeRemoteCache(t, blobs) + "/",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if blobs[digest] != binary {
+		t.Fatalf("Expected the binary to be uploaded to the remote cache, but got %v", blobs)
+	}
+}
+
+func TestDownloadFetchesFromRemoteCache(t *testing.T) {
+	binary := fakeBazelScript("cached remotely")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	tests := []struct {
+		name     string
+		blobs    map[string]string
+		upstream string
+	}{
+		{name: "Hit", blobs: map[string]string{digest: binary}, upstream: fakeBazelScript("must not be downloaded")},
+		{name: "Miss", blobs: map[string]string{}, upstream: binary},
+		{name: "Corrupted", blobs: map[string]string{digest: fakeBazelScript("corrupted")}, upstream: binary},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+				BaseURLEnv:               serveFakeBazel(t, test.upstream, nil),
+				RemoteCacheEnv:           serveFakeRemoteCache(t, test.blobs),
+				"BAZELISK_VERIFY_SHA256": digest,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if digestFromCASPath(path) != digest {
+				t.Fatalf("Expected the binary with digest %s, but got %s", digest, path)
+			}
+		})
+	}
+}
+
+func TestDownloadRejectsWrongBinaryFromRemoteCache(t *testing.T) {
+	binary := fakeBazelScript("from the internet")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	wrongBinary := fakeBazelScript("wrong")
+	blobs := map[string]string{digest: wrongBinary}
+
+	// The digest is known from an earlier download whose binary has been removed from the local cache since.
+	bazeliskHome := t.TempDir()
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, false, config.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := atomicWriteFile(filepath.Join(bazeliskHome, "downloads", "metadata", "fake", filename), []byte(digest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamRequests atomic.Int32
+	upstream := serveFakeBazel(t, binary, nil)
+	counting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		http.Redirect(w, r, upstream+r.URL.Path, http.StatusFound)
+	}))
+	t.Cleanup(counting.Close)
+
+	path, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:     counting.URL,
+		RemoteCacheEnv: serveFakeRemoteCache(t, blobs),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if digestFromCASPath(path) != digest {
+		t.Fatalf("Expected the binary with digest %s, but got %s", digest, path)
+	}
+	if got, _ := os.ReadFile(path); string(got) != binary {
+		t.Fatalf("Expected the binary from the internet, but got %q", got)
+	}
+	if upstreamRequests.Load() == 0 {
+		t.Fatalf("Expected Bazelisk to fall back to downloading the binary from the internet")
+	}
+	wrongDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(wrongBinary)))
+	if _, err := os.Stat(filepath.Join(bazeliskHome, "downloads", "sha256", wrongDigest)); !os.IsNotExist(err) {
+		t.Errorf("Expected the wrong binary not to be stored in the local cache")
+	}
+	if blobs[digest] != binary {
+		t.Errorf("Expected the correct binary to be uploaded to the remote cache again")
+	}
+}
+
+func TestRemoteCacheMustUseHTTP(t *testing.T) {
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:     serveFakeBazel(t, fakeBazelScript("bazel"), nil),
+		RemoteCacheEnv: "grpc://localhost:9092",
+	})
+	if err == nil || !strings.Contains(err.Error(), RemoteCacheEnv) {
+		t.Fatalf("Expected an error about %s, but got %v", RemoteCacheEnv, err)
+	}
+}
@@ -1,12 +1,12 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/bazelbuild/bazelisk/config"
-	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
 	"github.com/bazelbuild/bazelisk/versions"
 )
@@ -19,8 +19,8 @@ const (
 	FormatURLEnv = "BAZELISK_FORMAT_URL"
 )
 
-// DownloadFunc downloads a specific Bazel binary to the given location and returns the absolute path.
-type DownloadFunc func(destDir, destFile string) (string, error)
+// DownloadFunc downloads a specific Bazel binary for the given platform to the given location and returns the absolute path.
+type DownloadFunc func(platform platforms.Platform, destDir, destFile string) (string, error)
 
 // LTSFilter filters Bazel versions based on specific criteria.
 type LTSFilter func(string) bool
@@ -38,8 +38,19 @@ type LTSRepo interface {
 	// Warning: Filters only work reliably if the versions are processed in descending order!
 	GetLTSVersions(bazeliskHome string, opts *FilterOpts) ([]string, error)
 
-	// DownloadLTS downloads the given Bazel version into the specified location and returns the absolute path.
-	DownloadLTS(version, destDir, destFile string, config config.Config) (string, error)
+	// DownloadLTS downloads the given Bazel version for the given platform into the specified location and returns the absolute path.
+	DownloadLTS(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
+}
+
+// LTSRepoContext is an LTSRepo whose requests can be cancelled. Bazelisk prefers its methods if a repository implements them.
+type LTSRepoContext interface {
+	LTSRepo
+
+	// GetLTSVersionsContext is like GetLTSVersions, but aborts once the context is done.
+	GetLTSVersionsContext(ctx context.Context, bazeliskHome string, opts *FilterOpts) ([]string, error)
+
+	// DownloadLTSContext is like DownloadLTS, but aborts once the context is done.
+	DownloadLTSContext(ctx context.Context, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
 }
 
 // ForkRepo represents a repository that stores a fork of Bazel (releases).
@@ -47,8 +58,19 @@ type ForkRepo interface {
 	// GetVersions returns the versions of all available Bazel binaries in the given fork.
 	GetVersions(bazeliskHome, fork string) ([]string, error)
 
-	// DownloadVersion downloads the given Bazel binary from the specified fork into the given location and returns the absolute path.
-	DownloadVersion(fork, version, destDir, destFile string, config config.Config) (string, error)
+	// DownloadVersion downloads the given Bazel binary for the given platform from the specified fork into the given location and returns the absolute path.
+	DownloadVersion(fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
+}
+
+// ForkRepoContext is a ForkRepo whose requests can be cancelled. Bazelisk prefers its methods if a repository implements them.
+type ForkRepoContext interface {
+	ForkRepo
+
+	// GetVersionsContext is like GetVersions, but aborts once the context is done.
+	GetVersionsContext(ctx context.Context, bazeliskHome, fork string) ([]string, error)
+
+	// DownloadVersionContext is like DownloadVersion, but aborts once the context is done.
+	DownloadVersionContext(ctx context.Context, fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
 }
 
 // CommitRepo represents a repository that stores Bazel binaries built at specific commits.
@@ -57,8 +79,19 @@ type CommitRepo interface {
 	// GetLastGreenCommit returns the most recent commit at which a Bazel binary is successfully built.
 	GetLastGreenCommit(bazeliskHome string) (string, error)
 
-	// DownloadAtCommit downloads a Bazel binary built at the given commit into the specified location and returns the absolute path.
-	DownloadAtCommit(commit, destDir, destFile string, config config.Config) (string, error)
+	// DownloadAtCommit downloads a Bazel binary for the given platform built at the given commit into the specified location and returns the absolute path.
+	DownloadAtCommit(commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
+}
+
+// CommitRepoContext is a CommitRepo whose requests can be cancelled. Bazelisk prefers its methods if a repository implements them.
+type CommitRepoContext interface {
+	CommitRepo
+
+	// GetLastGreenCommitContext is like GetLastGreenCommit, but aborts once the context is done.
+	GetLastGreenCommitContext(ctx context.Context, bazeliskHome string) (string, error)
+
+	// DownloadAtCommitContext is like DownloadAtCommit, but aborts once the context is done.
+	DownloadAtCommitContext(ctx context.Context, commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
 }
 
 // RollingRepo represents a repository that stores rolling Bazel releases.
@@ -66,8 +99,19 @@ type RollingRepo interface {
 	// GetRollingVersions returns a list of all available rolling release versions.
 	GetRollingVersions(bazeliskHome string) ([]string, error)
 
-	// DownloadRolling downloads the given Bazel version into the specified location and returns the absolute path.
-	DownloadRolling(version, destDir, destFile string, config config.Config) (string, error)
+	// DownloadRolling downloads the given Bazel version for the given platform into the specified location and returns the absolute path.
+	DownloadRolling(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
+}
+
+// RollingRepoContext is a RollingRepo whose requests can be cancelled. Bazelisk prefers its methods if a repository implements them.
+type RollingRepoContext interface {
+	RollingRepo
+
+	// GetRollingVersionsContext is like GetRollingVersions, but aborts once the context is done.
+	GetRollingVersionsContext(ctx context.Context, bazeliskHome string) ([]string, error)
+
+	// DownloadRollingContext is like DownloadRolling, but aborts once the context is done.
+	DownloadRollingContext(ctx context.Context, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error)
 }
 
 // Repositories offers access to different types of Bazel repositories, mainly for finding and downloading the correct version of Bazel.
@@ -81,37 +125,57 @@ type Repositories struct {
 
 // ResolveVersion resolves a potentially relative Bazel version string such as "latest" to an absolute version identifier, and returns this identifier alongside a function to download said version.
 func (r *Repositories) ResolveVersion(bazeliskHome, fork, version string, config config.Config) (string, DownloadFunc, error) {
+	return r.ResolveVersionContext(context.Background(), bazeliskHome, fork, version, config)
+}
+
+// ResolveVersionContext is like ResolveVersion, but aborts the resolution once the context is done.
+// The returned function downloads the version with the same context.
+// Errors are of type *VersionParseError if the version cannot be parsed, and of type *ResolutionError otherwise.
+func (r *Repositories) ResolveVersionContext(ctx context.Context, bazeliskHome, fork, version string, config config.Config) (string, DownloadFunc, error) {
 	vi, err := versions.Parse(fork, version)
 	if err != nil {
-		return "", nil, err
+		return "", nil, &VersionParseError{Version: version, Err: err}
 	}
 
+	var resolved string
+	var downloader DownloadFunc
 	if vi.IsFork {
-		return r.resolveFork(bazeliskHome, vi, config)
+		resolved, downloader, err = r.resolveFork(ctx, bazeliskHome, vi, config)
 	} else if vi.IsLTS {
-		return r.resolveLTS(bazeliskHome, vi, config)
+		resolved, downloader, err = r.resolveLTS(ctx, bazeliskHome, vi, config)
 	} else if vi.IsCommit {
-		return r.resolveCommit(bazeliskHome, vi, config)
+		resolved, downloader, err = r.resolveCommit(ctx, bazeliskHome, vi, config)
 	} else if vi.IsRolling {
-		return r.resolveRolling(bazeliskHome, vi, config)
+		resolved, downloader, err = r.resolveRolling(ctx, bazeliskHome, vi, config)
+	} else {
+		err = fmt.Errorf("unsupported version identifier '%s'", version)
 	}
-
-	return "", nil, fmt.Errorf("unsupported version identifier '%s'", version)
+	if err != nil {
+		return "", nil, &ResolutionError{Fork: fork, Version: version, Err: err}
+	}
+	return resolved, downloader, nil
 }
 
-func (r *Repositories) resolveFork(bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+func (r *Repositories) resolveFork(ctx context.Context, bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
 	if vi.IsRelative && (vi.MustBeCandidate || vi.IsCommit) {
 		return "", nil, errors.New("forks do not support last_rc and last_green")
 	}
+	repo, hasContext := r.Fork.(ForkRepoContext)
 	lister := func(bazeliskHome string) ([]string, error) {
+		if hasContext {
+			return repo.GetVersionsContext(ctx, bazeliskHome, vi.Fork)
+		}
 		return r.Fork.GetVersions(bazeliskHome, vi.Fork)
 	}
 	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, lister, vi)
 	if err != nil {
 		return "", nil, err
 	}
-	downloader := func(destDir, destFile string) (string, error) {
-		return r.Fork.DownloadVersion(vi.Fork, version, destDir, destFile, config)
+	downloader := func(platform platforms.Platform, destDir, destFile string) (string, error) {
+		if hasContext {
+			return repo.DownloadVersionContext(ctx, vi.Fork, version, platform, destDir, destFile, config)
+		}
+		return r.Fork.DownloadVersion(vi.Fork, version, platform, destDir, destFile, config)
 	}
 	return version, downloader, nil
 }
@@ -124,7 +188,7 @@ var IsCandidate = func(version string) bool {
 	return strings.Contains(version, "rc")
 }
 
-func (r *Repositories) resolveLTS(bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+func (r *Repositories) resolveLTS(ctx context.Context, bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
 	opts := &FilterOpts{
 		// Optimization: only fetch last (x+1) releases if the version is "latest-x".
 		MaxResults: vi.LatestOffset + 1,
@@ -140,44 +204,66 @@ func (r *Repositories) resolveLTS(bazeliskHome string, vi *versions.Info, config
 		opts.Filter = func(v string) bool { return true }
 	}
 
+	repo, hasContext := r.LTS.(LTSRepoContext)
 	lister := func(bazeliskHome string) ([]string, error) {
+		if hasContext {
+			return repo.GetLTSVersionsContext(ctx, bazeliskHome, opts)
+		}
 		return r.LTS.GetLTSVersions(bazeliskHome, opts)
 	}
 	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, lister, vi)
 	if err != nil {
 		return "", nil, err
 	}
-	downloader := func(destDir, destFile string) (string, error) {
-		return r.LTS.DownloadLTS(version, destDir, destFile, config)
+	downloader := func(platform platforms.Platform, destDir, destFile string) (string, error) {
+		if hasContext {
+			return repo.DownloadLTSContext(ctx, version, platform, destDir, destFile, config)
+		}
+		return r.LTS.DownloadLTS(version, platform, destDir, destFile, config)
 	}
 	return version, downloader, nil
 }
 
-func (r *Repositories) resolveCommit(bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+func (r *Repositories) resolveCommit(ctx context.Context, bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+	repo, hasContext := r.Commits.(CommitRepoContext)
 	version := vi.Value
 	if vi.IsRelative {
 		var err error
-		version, err = r.Commits.GetLastGreenCommit(bazeliskHome)
+		if hasContext {
+			version, err = repo.GetLastGreenCommitContext(ctx, bazeliskHome)
+		} else {
+			version, err = r.Commits.GetLastGreenCommit(bazeliskHome)
+		}
 		if err != nil {
-			return "", nil, fmt.Errorf("cannot resolve last green commit: %v", err)
+			return "", nil, fmt.Errorf("cannot resolve last green commit: %w", err)
 		}
 	}
-	downloader := func(destDir, destFile string) (string, error) {
-		return r.Commits.DownloadAtCommit(version, destDir, destFile, config)
+	downloader := func(platform platforms.Platform, destDir, destFile string) (string, error) {
+		if hasContext {
+			return repo.DownloadAtCommitContext(ctx, version, platform, destDir, destFile, config)
+		}
+		return r.Commits.DownloadAtCommit(version, platform, destDir, destFile, config)
 	}
 	return version, downloader, nil
 }
 
-func (r *Repositories) resolveRolling(bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+func (r *Repositories) resolveRolling(ctx context.Context, bazeliskHome string, vi *versions.Info, config config.Config) (string, DownloadFunc, error) {
+	repo, hasContext := r.Rolling.(RollingRepoContext)
 	lister := func(bazeliskHome string) ([]string, error) {
+		if hasContext {
+			return repo.GetRollingVersionsContext(ctx, bazeliskHome)
+		}
 		return r.Rolling.GetRollingVersions(bazeliskHome)
 	}
 	version, err := resolvePotentiallyRelativeVersion(bazeliskHome, lister, vi)
 	if err != nil {
 		return "", nil, err
 	}
-	downloader := func(destDir, destFile string) (string, error) {
-		return r.Rolling.DownloadRolling(version, destDir, destFile, config)
+	downloader := func(platform platforms.Platform, destDir, destFile string) (string, error) {
+		if hasContext {
+			return repo.DownloadRollingContext(ctx, version, platform, destDir, destFile, config)
+		}
+		return r.Rolling.DownloadRolling(version, platform, destDir, destFile, config)
 	}
 	return version, downloader, nil
 }
@@ -191,7 +277,7 @@ func resolvePotentiallyRelativeVersion(bazeliskHome string, lister listVersionsF
 
 	available, err := lister(bazeliskHome)
 	if err != nil {
-		return "", fmt.Errorf("unable to determine latest version: %v", err)
+		return "", fmt.Errorf("unable to determine latest version: %w", err)
 	}
 
 	index := len(available) - 1 - vi.LatestOffset
@@ -203,33 +289,40 @@ func resolvePotentiallyRelativeVersion(bazeliskHome string, lister listVersionsF
 }
 
 // DownloadFromBaseURL can download Bazel binaries from a specific URL while ignoring the predefined repositories.
-func (r *Repositories) DownloadFromBaseURL(baseURL, version, destDir, destFile string, config config.Config) (string, error) {
+func (r *Repositories) DownloadFromBaseURL(baseURL, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return r.DownloadFromBaseURLContext(context.Background(), baseURL, version, platform, destDir, destFile, config)
+}
+
+// DownloadFromBaseURLContext is like DownloadFromBaseURL, but aborts the download once the context is done.
+func (r *Repositories) DownloadFromBaseURLContext(ctx context.Context, baseURL, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	if !r.supportsBaseURL {
 		return "", fmt.Errorf("downloads from %s are forbidden", BaseURLEnv)
 	} else if baseURL == "" {
 		return "", fmt.Errorf("%s is not set", BaseURLEnv)
 	}
 
-	srcFile, err := platforms.DetermineBazelFilename(version, true, config)
+	srcFile, err := platforms.DetermineBazelFilenameForPlatform(version, platform, true, config)
 	if err != nil {
 		return "", err
 	}
 
 	url := fmt.Sprintf("%s/%s/%s", baseURL, version, srcFile)
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	return DownloadBinaryWithSidecarsContext(ctx, url, destDir, destFile, config)
 }
 
-// BuildURLFromFormat returns a Bazel download URL based on formatURL.
+// BuildURLFromFormat returns a Bazel download URL for the current platform based on formatURL.
 func BuildURLFromFormat(config config.Config, formatURL, version string) (string, error) {
-	osName, err := platforms.DetermineOperatingSystem()
+	platform, err := platforms.CurrentPlatform()
 	if err != nil {
 		return "", err
 	}
+	return BuildURLFromFormatForPlatform(config, formatURL, version, platform)
+}
 
-	machineName, err := platforms.DetermineArchitecture(osName, version)
-	if err != nil {
-		return "", err
-	}
+// BuildURLFromFormatForPlatform returns a Bazel download URL for the given platform based on formatURL.
+func BuildURLFromFormatForPlatform(config config.Config, formatURL, version string, platform platforms.Platform) (string, error) {
+	osName := platform.OS
+	machineName := platform.ArchitectureForVersion(version)
 
 	var b strings.Builder
 	b.Grow(len(formatURL) * 2) // Approximation.
@@ -244,9 +337,13 @@ func BuildURLFromFormat(config config.Config, formatURL, version string) (string
 			ch = formatURL[i]
 			switch ch {
 			case 'e':
-				b.WriteString(platforms.DetermineExecutableFilenameSuffix())
+				b.WriteString(platform.ExecutableFilenameSuffix())
 			case 'h':
-				b.WriteString(config.Get("BAZELISK_VERIFY_SHA256"))
+				sha256, err := sha256ForFormatURL(config, version, platform)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(sha256)
 			case 'm':
 				b.WriteString(machineName)
 			case 'o':
@@ -265,18 +362,47 @@ func BuildURLFromFormat(config config.Config, formatURL, version string) (string
 	return b.String(), nil
 }
 
+// sha256ForFormatURL returns the value of the %h placeholder. Since BAZELISK_VERIFY_SHA256 only pins the binary for the current platform,
+// the digests of binaries for other platforms come from the checksums file.
+func sha256ForFormatURL(config config.Config, version string, platform platforms.Platform) (string, error) {
+	currentPlatform, err := platforms.CurrentPlatform()
+	if err != nil {
+		return "", err
+	}
+	if platform == currentPlatform {
+		return config.Get("BAZELISK_VERIFY_SHA256"), nil
+	}
+
+	filename, err := platforms.DetermineBazelFilenameForPlatform(version, platform, false, config)
+	if err != nil {
+		return "", err
+	}
+	sha256, err := getExpectedSha256(versions.BazelUpstream, filename, platform, config)
+	if err != nil {
+		return "", err
+	} else if sha256 == "" {
+		return "", fmt.Errorf("cannot substitute %%h for %s: BAZELISK_VERIFY_SHA256 only applies to the current platform, and %s has no checksum for it", filename, ChecksumsFileEnv)
+	}
+	return sha256, nil
+}
+
 // DownloadFromFormatURL can download Bazel binaries from a specific URL while ignoring the predefined repositories.
-func (r *Repositories) DownloadFromFormatURL(config config.Config, formatURL, version, destDir, destFile string) (string, error) {
+func (r *Repositories) DownloadFromFormatURL(config config.Config, formatURL, version string, platform platforms.Platform, destDir, destFile string) (string, error) {
+	return r.DownloadFromFormatURLContext(context.Background(), config, formatURL, version, platform, destDir, destFile)
+}
+
+// DownloadFromFormatURLContext is like DownloadFromFormatURL, but aborts the download once the context is done.
+func (r *Repositories) DownloadFromFormatURLContext(ctx context.Context, config config.Config, formatURL, version string, platform platforms.Platform, destDir, destFile string) (string, error) {
 	if formatURL == "" {
 		return "", fmt.Errorf("%s is not set", FormatURLEnv)
 	}
 
-	url, err := BuildURLFromFormat(config, formatURL, version)
+	url, err := BuildURLFromFormatForPlatform(config, formatURL, version, platform)
 	if err != nil {
 		return "", err
 	}
 
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	return DownloadBinaryWithSidecarsContext(ctx, url, destDir, destFile, config)
 }
 
 // CreateRepositories creates a new Repositories instance with the given repositories. Any nil repository will be replaced by a dummy repository that raises an error whenever a download is attempted.
@@ -321,7 +447,7 @@ func (nolts *noLTSRepo) GetLTSVersions(bazeliskHome string, opts *FilterOpts) ([
 	return nil, nolts.err
 }
 
-func (nolts *noLTSRepo) DownloadLTS(version, destDir, destFile string, config config.Config) (string, error) {
+func (nolts *noLTSRepo) DownloadLTS(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	return "", nolts.err
 }
 
@@ -333,7 +459,7 @@ func (nfr *noForkRepo) GetVersions(bazeliskHome, fork string) ([]string, error)
 	return nil, nfr.err
 }
 
-func (nfr *noForkRepo) DownloadVersion(fork, version, destDir, destFile string, config config.Config) (string, error) {
+func (nfr *noForkRepo) DownloadVersion(fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	return "", nfr.err
 }
 
@@ -345,7 +471,7 @@ func (nlgr *noCommitRepo) GetLastGreenCommit(bazeliskHome string) (string, error
 	return "", nlgr.err
 }
 
-func (nlgr *noCommitRepo) DownloadAtCommit(commit, destDir, destFile string, config config.Config) (string, error) {
+func (nlgr *noCommitRepo) DownloadAtCommit(commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	return "", nlgr.err
 }
 
@@ -357,6 +483,6 @@ func (nrr *noRollingRepo) GetRollingVersions(bazeliskHome string) ([]string, err
 	return nil, nrr.err
 }
 
-func (nrr *noRollingRepo) DownloadRolling(version, destDir, destFile string, config config.Config) (string, error) {
+func (nrr *noRollingRepo) DownloadRolling(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	return "", nrr.err
 }
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/bazelisk/config"
@@ -68,3 +72,93 @@ func TestBuildURLFromFormat(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildURLFromFormatOnlyUsesVerifySha256ForCurrentPlatform(t *testing.T) {
+	current, err := platforms.CurrentPlatform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := platforms.Platform{OS: "windows", Arch: "x86_64"}
+	if current == other {
+		other = platforms.Platform{OS: "linux", Arch: "x86_64"}
+	}
+	otherFilename, err := platforms.DetermineBazelFilenameForPlatform(fakeBazelVersion, other, false, config.Null())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksumsPath := filepath.Join(t.TempDir(), "checksums.txt")
+	otherSha256 := strings.Repeat("c", 64)
+	if err := os.WriteFile(checksumsPath, []byte(otherSha256+"  "+otherFilename+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"BAZELISK_VERIFY_SHA256": "CurrentSha256"}
+
+	if got, err := BuildURLFromFormatForPlatform(config.Static(values), "https://cas.example.com/%h", fakeBazelVersion, current); err != nil || got != "https://cas.example.com/CurrentSha256" {
+		t.Errorf("Expected the pinned digest for the current platform, but got %q (%v)", got, err)
+	}
+	if _, err := BuildURLFromFormatForPlatform(config.Static(values), "https://cas.example.com/%h", fakeBazelVersion, other); err == nil || !strings.Contains(err.Error(), ChecksumsFileEnv) {
+		t.Errorf("Expected an error without a checksum for %s, but got %v", other, err)
+	}
+	values[ChecksumsFileEnv] = checksumsPath
+	if got, err := BuildURLFromFormatForPlatform(config.Static(values), "https://cas.example.com/%h", fakeBazelVersion, other); err != nil || got != "https://cas.example.com/"+otherSha256 {
+		t.Errorf("Expected the digest from the checksums file for %s, but got %q (%v)", other, got, err)
+	}
+}
+
+// legacyForkRepo only implements ForkRepo, like repositories that were written before ForkRepoContext existed.
+type legacyForkRepo struct{}
+
+func (legacyForkRepo) GetVersions(bazeliskHome, fork string) ([]string, error) {
+	return []string{"1.0.0", "2.0.0"}, nil
+}
+
+func (legacyForkRepo) DownloadVersion(fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return filepath.Join(destDir, fork+"-"+version), nil
+}
+
+// contextForkRepo implements ForkRepoContext and records the contexts that it receives.
+type contextForkRepo struct {
+	legacyForkRepo
+	contexts []context.Context
+}
+
+func (r *contextForkRepo) GetVersionsContext(ctx context.Context, bazeliskHome, fork string) ([]string, error) {
+	r.contexts = append(r.contexts, ctx)
+	return r.GetVersions(bazeliskHome, fork)
+}
+
+func (r *contextForkRepo) DownloadVersionContext(ctx context.Context, fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	r.contexts = append(r.contexts, ctx)
+	return r.DownloadVersion(fork, version, platform, destDir, destFile, config)
+}
+
+type testContextKey struct{}
+
+func TestResolveVersionSupportsReposWithAndWithoutContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), testContextKey{}, "test")
+	withContext := &contextForkRepo{}
+	for _, repo := range []ForkRepo{legacyForkRepo{}, withContext} {
+		repos := CreateRepositories(nil, repo, nil, nil, false)
+		version, downloader, err := repos.ResolveVersionContext(ctx, t.TempDir(), "somefork", "latest", config.Null())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if version != "2.0.0" {
+			t.Fatalf("Expected version 2.0.0, but got %s", version)
+		}
+		path, err := downloader(platforms.Platform{OS: "linux", Arch: "x86_64"}, "dir", "bazel")
+		if err != nil || path != filepath.Join("dir", "somefork-2.0.0") {
+			t.Fatalf("Expected the binary to be downloaded, but got %q (%v)", path, err)
+		}
+	}
+
+	if len(withContext.contexts) != 2 {
+		t.Fatalf("Expected both the listing and the download to use the context-aware methods, but got %d calls", len(withContext.contexts))
+	}
+	for _, got := range withContext.contexts {
+		if got.Value(testContextKey{}) != "test" {
+			t.Errorf("Expected the context of ResolveVersionContext to be passed to the repository")
+		}
+	}
+}
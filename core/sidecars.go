@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+)
+
+const (
+	// SHA256SidecarEnv is the name of the environment variable that controls how Bazelisk uses the published .sha256 files of Bazel binaries.
+	// It can be "optional" (default: verify the checksum if the file exists), "warn" (like "optional", but warn if it doesn't exist),
+	// "required" (fail if the file doesn't exist) or "off" (don't download the file at all).
+	SHA256SidecarEnv = "BAZELISK_SHA256_SIDECAR"
+
+	sha256SidecarSuffix = ".sha256"
+
+	// sourceURLSuffix is appended to the path of a downloaded Bazel binary to get the file that records where it was downloaded from.
+	sourceURLSuffix = ".url"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// DownloadBinaryWithSidecars downloads a Bazel binary just like httputil.DownloadBinary, but also fetches the files that are published next to it
+// (such as its sha256 checksum). Bazelisk verifies the binary against these files before it admits the binary into its cache.
+func DownloadBinaryWithSidecars(url, destDir, destFile string, config config.Config) (string, error) {
+	return DownloadBinaryWithSidecarsContext(context.Background(), url, destDir, destFile, config)
+}
+
+// DownloadBinaryWithSidecarsContext is like DownloadBinaryWithSidecars, but aborts the downloads once the context is done.
+// If a sidecar cannot be downloaded, the binary and the sidecars that were downloaded before are removed again.
+func DownloadBinaryWithSidecarsContext(ctx context.Context, url, destDir, destFile string, config config.Config) (string, error) {
+	path, err := DownloadBinaryWithSourceContext(ctx, url, destDir, destFile, config)
+	if err != nil {
+		return "", err
+	}
+
+	if err := downloadSidecars(ctx, url, path, config); err != nil {
+		os.Remove(path)
+		removeSidecars(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// DownloadBinaryWithSourceContext downloads a Bazel binary just like httputil.DownloadBinaryContext, but also records the URL it was
+// downloaded from, so that Bazelisk can report where a binary that fails validation came from.
+func DownloadBinaryWithSourceContext(ctx context.Context, url, destDir, destFile string, config config.Config) (string, error) {
+	path, err := httputil.DownloadBinaryContext(ctx, url, destDir, destFile, config)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+sourceURLSuffix, []byte(httputil.RedactURL(url)), 0644); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("could not record source of %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// takeSourceURL returns the (redacted) URL that the Bazel binary at path was downloaded from, or an empty string if it's unknown,
+// and removes the file that records it.
+func takeSourceURL(path string) string {
+	url, err := os.ReadFile(path + sourceURLSuffix)
+	if err != nil {
+		return ""
+	}
+	os.Remove(path + sourceURLSuffix)
+	return string(url)
+}
+
+func downloadSidecars(ctx context.Context, url, path string, config config.Config) error {
+	if err := downloadSHA256Sidecar(ctx, url, path, config); err != nil {
+		return err
+	}
+
+	if isSignatureVerificationEnabled(config) {
+		sigPath, err := httputil.DownloadSidecarContext(ctx, url, signatureSidecarSuffix, path)
+		if err != nil {
+			return fmt.Errorf("could not download signature of %s: %w", httputil.RedactURL(url), err)
+		}
+		if sigPath == "" {
+			return fmt.Errorf("%s does not exist, but %s is set", httputil.RedactURL(httputil.SidecarURL(url, signatureSidecarSuffix)), VerifySignatureEnv)
+		}
+	}
+
+	if isProvenanceVerificationEnabled(config) {
+		suffix := getProvenanceSuffix(config)
+		attestationPath, err := httputil.DownloadSidecarContext(ctx, url, suffix, path)
+		if err != nil {
+			return fmt.Errorf("could not download provenance attestation of %s: %w", httputil.RedactURL(url), err)
+		}
+		if attestationPath == "" {
+			return fmt.Errorf("%s does not exist, but %s is set", httputil.RedactURL(httputil.SidecarURL(url, suffix)), VerifyProvenanceEnv)
+		}
+		// Use a fixed name so that verifySidecars can find the attestation regardless of the configured suffix.
+		if err := os.Rename(attestationPath, path+defaultProvenanceSuffix); err != nil {
+			return fmt.Errorf("could not move %s: %v", attestationPath, err)
+		}
+	}
+	return nil
+}
+
+func downloadSHA256Sidecar(ctx context.Context, url, path string, config config.Config) error {
+	policy := strings.ToLower(config.Get(SHA256SidecarEnv))
+	switch policy {
+	case "", "optional", "warn", "required":
+	case "off":
+		return nil
+	default:
+		return fmt.Errorf("invalid value %q for %s, must be one of optional, warn, required or off", policy, SHA256SidecarEnv)
+	}
+
+	sidecarPath, err := httputil.DownloadSidecarContext(ctx, url, sha256SidecarSuffix, path)
+	if err != nil {
+		// Some mirrors (e.g. S3 buckets) respond with 403 instead of 404 if a file does not exist, so only fail if the checksum is required.
+		if policy == "required" || ctx.Err() != nil {
+			return fmt.Errorf("could not download checksum of %s: %w", httputil.RedactURL(url), err)
+		}
+		log.Printf("Warning: cannot verify %s since its checksum could not be downloaded: %v", httputil.RedactURL(url), err)
+		return nil
+	}
+	if sidecarPath == "" {
+		sidecarURL := httputil.RedactURL(httputil.SidecarURL(url, sha256SidecarSuffix))
+		if policy == "required" {
+			return fmt.Errorf("%s does not exist, but %s=required", sidecarURL, SHA256SidecarEnv)
+		} else if policy == "warn" {
+			log.Printf("Warning: cannot verify %s since %s does not exist", httputil.RedactURL(url), sidecarURL)
+		}
+	}
+	return nil
+}
+
+// verifySidecars checks the downloaded Bazel binary at path against the files that were downloaded alongside it, and removes these files afterwards.
+// It returns the verified provenance of the binary if provenance verification is enabled.
+func verifySidecars(path, actualSha256 string, config config.Config) (*provenanceRecord, error) {
+	defer removeSidecars(path)
+	if err := verifySHA256Sidecar(path, actualSha256); err != nil {
+		return nil, err
+	}
+
+	sigPath := path + signatureSidecarSuffix
+	if isSignatureVerificationEnabled(config) {
+		if _, err := os.Stat(sigPath); err != nil {
+			return nil, fmt.Errorf("cannot verify signature of downloaded Bazel binary since no signature was downloaded, but %s is set", VerifySignatureEnv)
+		}
+		if err := verifySignature(path, sigPath, config); err != nil {
+			return nil, err
+		}
+	}
+
+	attestationPath := path + defaultProvenanceSuffix
+	if isProvenanceVerificationEnabled(config) {
+		if _, err := os.Stat(attestationPath); err != nil {
+			return nil, fmt.Errorf("cannot verify provenance of downloaded Bazel binary since no attestation was downloaded, but %s is set", VerifyProvenanceEnv)
+		}
+		return verifyProvenance(attestationPath, actualSha256, config)
+	}
+	return nil, nil
+}
+
+// removeSidecars removes the files that were downloaded alongside the Bazel binary at path.
+func removeSidecars(path string) {
+	for _, suffix := range []string{sha256SidecarSuffix, signatureSidecarSuffix, defaultProvenanceSuffix, sourceURLSuffix} {
+		os.Remove(path + suffix)
+	}
+}
+
+func verifySHA256Sidecar(path, actualSha256 string) error {
+	sidecarPath := path + sha256SidecarSuffix
+	contents, err := os.ReadFile(sidecarPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read published checksum %s: %v", sidecarPath, err)
+	}
+	defer os.Remove(sidecarPath)
+
+	// The file has the same format as the output of `sha256sum`, i.e. "<digest>  <filename>".
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 || !sha256Pattern.MatchString(strings.ToLower(fields[0])) {
+		return fmt.Errorf("published checksum %s does not contain a sha256 digest", sidecarPath)
+	}
+	if expectedSha256 := strings.ToLower(fields[0]); expectedSha256 != actualSha256 {
+		return &ChecksumMismatchError{Path: path, Actual: actualSha256, Expected: expectedSha256, Source: "its published checksum"}
+	}
+	return nil
+}
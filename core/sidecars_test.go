@@ -0,0 +1,149 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/platforms"
+	"github.com/bazelbuild/bazelisk/versions"
+)
+
+const fakeBazelVersion = "7.4.1"
+
+// serveFakeBazel serves a fake Bazel binary in the layout expected by BAZELISK_BASE_URL, along with the given files that are published next to it.
+func serveFakeBazel(t *testing.T, binary string, sidecars map[string]string) string {
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, true, config.Null())
+	if err != nil {
+		t.Fatalf("Could not determine Bazel filename: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+fakeBazelVersion+"/"+filename, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(binary))
+	})
+	for suffix, contents := range sidecars {
+		mux.HandleFunc("/"+fakeBazelVersion+"/"+filename+suffix, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(contents))
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// fakeBazelScript returns the contents of a fake Bazel binary, which has to be an executable to pass validation.
+func fakeBazelScript(name string) string {
+	return "#!/bin/sh\necho " + name + "\n"
+}
+
+func downloadFakeBazel(t *testing.T, bazeliskHome string, values map[string]string) (string, error) {
+	platform, err := platforms.CurrentPlatform()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := CreateRepositories(nil, nil, nil, nil, true)
+	return downloadBazelIfNecessary(context.Background(), fakeBazelVersion, platform, bazeliskHome, versions.BazelUpstream, "fake", repos, config.Static(values), nil)
+}
+
+func TestDownloadVerifiesPublishedChecksum(t *testing.T) {
+	binary := fakeBazelScript("fake bazel")
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(binary)))
+	baseURL := serveFakeBazel(t, binary, map[string]string{".sha256": digest + "  bazel\n"})
+	bazeliskHome := t.TempDir()
+
+	path, err := downloadFakeBazel(t, bazeliskHome, map[string]string{BaseURLEnv: baseURL})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(path, digest) {
+		t.Fatalf("Expected %s to be stored under its digest %s", path, digest)
+	}
+
+	leftovers, _ := os.ReadDir(filepath.Join(bazeliskHome, "downloads", "_tmp"))
+	if len(leftovers) != 0 {
+		t.Fatalf("Expected no leftover temporary files, but got %d", len(leftovers))
+	}
+}
+
+func TestDownloadFailsOnChecksumMismatch(t *testing.T) {
+	wrongDigest := strings.Repeat("ab", 32)
+	baseURL := serveFakeBazel(t, fakeBazelScript("tampered"), map[string]string{".sha256": wrongDigest + "  bazel\n"})
+	bazeliskHome := t.TempDir()
+
+	_, err := downloadFakeBazel(t, bazeliskHome, map[string]string{BaseURLEnv: baseURL})
+	if err == nil || !strings.Contains(err.Error(), "its published checksum is sha256="+wrongDigest) {
+		t.Fatalf("Expected checksum mismatch error, but got %v", err)
+	}
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Expected != wrongDigest {
+		t.Fatalf("Expected a *ChecksumMismatchError, but got %T", err)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(bazeliskHome, "downloads", "sha256")); len(entries) != 0 {
+		t.Fatalf("Expected the mismatching binary not to be admitted into the CAS")
+	}
+}
+
+func TestDownloadRemovesSidecarsOnChecksumMismatch(t *testing.T) {
+	wrongDigest := strings.Repeat("ab", 32)
+	baseURL := serveFakeBazel(t, fakeBazelScript("tampered"), map[string]string{
+		".sha256": wrongDigest + "  bazel\n",
+		".sig":    "signature",
+	})
+	bazeliskHome := t.TempDir()
+
+	_, err := downloadFakeBazel(t, bazeliskHome, map[string]string{BaseURLEnv: baseURL, VerifySignatureEnv: "1"})
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a *ChecksumMismatchError, but got %v", err)
+	}
+	if leftovers, _ := os.ReadDir(filepath.Join(bazeliskHome, "downloads", "_tmp")); len(leftovers) != 0 {
+		t.Fatalf("Expected no leftover temporary files, but got %v", leftovers)
+	}
+}
+
+func TestDownloadWithMissingChecksum(t *testing.T) {
+	baseURL := serveFakeBazel(t, fakeBazelScript("binary"), nil)
+
+	if _, err := downloadFakeBazel(t, t.TempDir(), map[string]string{BaseURLEnv: baseURL}); err != nil {
+		t.Fatalf("Expected missing checksum to be accepted by default, but got %v", err)
+	}
+
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{BaseURLEnv: baseURL, SHA256SidecarEnv: "required"})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Expected missing checksum to be rejected, but got %v", err)
+	}
+}
+
+func TestDownloadToleratesForbiddenChecksumUnlessRequired(t *testing.T) {
+	filename, err := platforms.DetermineBazelFilename(fakeBazelVersion, true, config.Null())
+	if err != nil {
+		t.Fatalf("Could not determine Bazel filename: %v", err)
+	}
+	// Like S3, respond with 403 for files that don't exist.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+fakeBazelVersion+"/"+filename {
+			w.Write([]byte(fakeBazelScript("binary")))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := downloadFakeBazel(t, t.TempDir(), map[string]string{BaseURLEnv: server.URL}); err != nil {
+		t.Fatalf("Expected an inaccessible checksum to be tolerated by default, but got %v", err)
+	}
+	_, err = downloadFakeBazel(t, t.TempDir(), map[string]string{BaseURLEnv: server.URL, SHA256SidecarEnv: "required"})
+	if err == nil || !strings.Contains(err.Error(), "could not download checksum") {
+		t.Fatalf("Expected an inaccessible checksum to fail the download if it is required, but got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+const (
+	// VerifySignatureEnv is the name of the environment variable that enables the verification of the detached GPG signatures (.sig files) of Bazel binaries.
+	VerifySignatureEnv = "BAZELISK_VERIFY_SIGNATURE"
+
+	// GPGPublicKeyEnv is the name of the environment variable that stores the path of the public key(s) that Bazel binaries must be signed with.
+	// By default Bazelisk uses the key that signs official Bazel releases.
+	GPGPublicKeyEnv = "BAZELISK_GPG_PUBLIC_KEY"
+
+	signatureSidecarSuffix = ".sig"
+)
+
+// bazelReleaseKey contains the armored public key that signs official Bazel releases, as published at https://bazel.build/bazel-release.pub.gpg.
+//
+//go:embed bazel-release.pub.gpg
+var bazelReleaseKey string
+
+func isSignatureVerificationEnabled(config config.Config) bool {
+	switch strings.ToLower(config.Get(VerifySignatureEnv)) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+// getSigningKeyring returns the public keys that may sign Bazel binaries.
+func getSigningKeyring(config config.Config) (openpgp.EntityList, error) {
+	contents := []byte(bazelReleaseKey)
+	source := "the embedded Bazel release key"
+	if path := config.Get(GPGPublicKeyEnv); path != "" {
+		var err error
+		if contents, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("could not read public key from %s: %v", path, err)
+		}
+		source = path
+	} else if len(contents) == 0 {
+		return nil, fmt.Errorf("no embedded Bazel release key is available, please set %s to the path of https://bazel.build/bazel-release.pub.gpg", GPGPublicKeyEnv)
+	}
+
+	var keyring openpgp.EntityList
+	var err error
+	if isArmored(contents) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(contents))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(contents))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse public key from %s: %v", source, err)
+	}
+	return keyring, nil
+}
+
+// verifySignature checks that the detached signature at sigPath was created for the file at path by one of the configured keys.
+func verifySignature(path, sigPath string, config config.Config) error {
+	keyring, err := getSigningKeyring(config)
+	if err != nil {
+		return err
+	}
+
+	signature, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("could not read signature %s: %v", sigPath, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s to verify its signature: %v", path, err)
+	}
+	defer f.Close()
+
+	if isArmored(signature) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, f, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid GPG signature for downloaded Bazel binary: %v", err)
+	}
+	return nil
+}
+
+func isArmored(contents []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(contents), []byte("-----BEGIN PGP"))
+}
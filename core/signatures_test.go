@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+// newSigningKey generates a key pair and stores its armored public key in a file.
+func newSigningKey(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Test Release", "", "release@example.com", nil)
+	if err != nil {
+		t.Fatalf("Could not generate key pair: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("Could not armor public key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("Could not serialize public key: %v", err)
+	}
+	w.Close()
+
+	path := filepath.Join(t.TempDir(), "release.pub.asc")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write public key: %v", err)
+	}
+	return entity, path
+}
+
+func sign(t *testing.T, signer *openpgp.Entity, contents string) string {
+	var sig bytes.Buffer
+	if err := openpgp.DetachSign(&sig, signer, strings.NewReader(contents), nil); err != nil {
+		t.Fatalf("Could not sign: %v", err)
+	}
+	return sig.String()
+}
+
+func TestDownloadVerifiesSignature(t *testing.T) {
+	signer, publicKeyPath := newSigningKey(t)
+	binary := fakeBazelScript("signed bazel")
+	baseURL := serveFakeBazel(t, binary, map[string]string{".sig": sign(t, signer, binary)})
+
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:         baseURL,
+		VerifySignatureEnv: "1",
+		GPGPublicKeyEnv:    publicKeyPath,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestDownloadRejectsInvalidSignature(t *testing.T) {
+	_, publicKeyPath := newSigningKey(t)
+	otherSigner, _ := newSigningKey(t)
+	binary := fakeBazelScript("bazel signed by someone else")
+	baseURL := serveFakeBazel(t, binary, map[string]string{".sig": sign(t, otherSigner, binary)})
+	bazeliskHome := t.TempDir()
+
+	_, err := downloadFakeBazel(t, bazeliskHome, map[string]string{
+		BaseURLEnv:         baseURL,
+		VerifySignatureEnv: "1",
+		GPGPublicKeyEnv:    publicKeyPath,
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid GPG signature") {
+		t.Fatalf("Expected invalid signature error, but got %v", err)
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(bazeliskHome, "downloads", "sha256")); len(entries) != 0 {
+		t.Fatalf("Expected the binary with an invalid signature not to be admitted into the CAS")
+	}
+}
+
+func TestDownloadRequiresSignatureWhenEnabled(t *testing.T) {
+	_, publicKeyPath := newSigningKey(t)
+	baseURL := serveFakeBazel(t, fakeBazelScript("unsigned bazel"), nil)
+
+	_, err := downloadFakeBazel(t, t.TempDir(), map[string]string{
+		BaseURLEnv:         baseURL,
+		VerifySignatureEnv: "1",
+		GPGPublicKeyEnv:    publicKeyPath,
+	})
+	if err == nil || !strings.Contains(err.Error(), ".sig does not exist") {
+		t.Fatalf("Expected missing signature error, but got %v", err)
+	}
+}
+
+func TestEmbeddedReleaseKeyCanBeParsed(t *testing.T) {
+	if bazelReleaseKey == "" {
+		t.Skip("bazel-release.pub.gpg does not contain the Bazel release key yet")
+	}
+	keyring, err := getSigningKeyring(config.Null())
+	if err != nil {
+		t.Fatalf("Could not parse embedded release key: %v", err)
+	}
+	if len(keyring) == 0 {
+		t.Fatal("Embedded release key does not contain any keys")
+	}
+}
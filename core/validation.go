@@ -0,0 +1,150 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil"
+	"github.com/bazelbuild/bazelisk/platforms"
+)
+
+const (
+	// SmokeTestEnv is the name of the environment variable that makes Bazelisk run `bazel --version` with every downloaded binary before it admits the binary into its cache.
+	SmokeTestEnv = "BAZELISK_SMOKE_TEST"
+
+	smokeTestTimeout = time.Minute
+)
+
+var (
+	// minBinarySize is the size below which a downloaded native executable cannot possibly be a Bazel binary.
+	minBinarySize int64 = 1024 * 1024
+
+	// executableMagics maps the first bytes of the executable formats that Bazel is published in to the names of these formats.
+	executableMagics = []struct {
+		magic  []byte
+		format string
+	}{
+		{[]byte("\x7fELF"), "ELF"},
+		{[]byte{0xfe, 0xed, 0xfa, 0xce}, "Mach-O"},
+		{[]byte{0xfe, 0xed, 0xfa, 0xcf}, "Mach-O"},
+		{[]byte{0xce, 0xfa, 0xed, 0xfe}, "Mach-O"},
+		{[]byte{0xcf, 0xfa, 0xed, 0xfe}, "Mach-O"},
+		{[]byte{0xca, 0xfe, 0xba, 0xbe}, "Mach-O universal"},
+		{[]byte("MZ"), "PE"},
+		{[]byte("#!"), "script"},
+	}
+)
+
+func isSmokeTestEnabled(config config.Config) bool {
+	switch strings.ToLower(config.Get(SmokeTestEnv)) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+// validateBinary checks that the file at path looks like a Bazel binary, so that error pages of captive portals or misconfigured mirrors
+// do not end up in the cache. Scripts are accepted regardless of their size. url is the (possibly empty) URL that the file was downloaded from.
+func validateBinary(path, url string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s to validate it: %v", path, err)
+	}
+	defer f.Close()
+
+	prefix := make([]byte, 64)
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("could not read %s to validate it: %v", path, err)
+	}
+	prefix = prefix[:n]
+
+	stat, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat %s to validate it: %v", path, err)
+	}
+
+	format := ""
+	for _, m := range executableMagics {
+		if bytes.HasPrefix(prefix, m.magic) {
+			format = m.format
+			break
+		}
+	}
+
+	if format == "" {
+		return fmt.Errorf("%s is not an executable (first bytes: %q)", describeDownload(url), prefix)
+	} else if format != "script" && stat.Size() < minBinarySize {
+		return fmt.Errorf("%s has only %d bytes, which is too small for a Bazel binary in %s format (first bytes: %q)", describeDownload(url), stat.Size(), format, prefix)
+	}
+	return nil
+}
+
+// describeDownload returns how error messages refer to a downloaded file, naming the URL it was downloaded from if it's known.
+func describeDownload(url string) string {
+	if url == "" {
+		return "downloaded file"
+	}
+	return "file downloaded from " + httputil.RedactURL(url)
+}
+
+// smokeTestBinary runs the smoke test for binaries of the current platform if it's enabled. It must only be called once the binary
+// has passed all checksum, signature and provenance checks, since it executes the binary.
+func smokeTestBinary(path, url string, platform platforms.Platform, config config.Config) error {
+	if current, err := platforms.CurrentPlatform(); err == nil && current == platform && isSmokeTestEnabled(config) {
+		return runSmokeTest(path, url)
+	}
+	return nil
+}
+
+// runSmokeTest runs `bazel --version` in an empty directory, which neither starts a Bazel server nor needs a workspace.
+func runSmokeTest(path, url string) error {
+	scratchDir, err := os.MkdirTemp(filepath.Dir(path), "smoke-test")
+	if err != nil {
+		return fmt.Errorf("could not create directory for smoke test: %v", err)
+	}
+	defer os.RemoveAll(scratchDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), smokeTestTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.Dir = scratchDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed to run `bazel --version`: %v\n%s", describeDownload(url), err, output)
+	}
+	return nil
+}
+
+// quarantineBinary moves a downloaded file that failed validation out of the way, so that it can be inspected later, and returns its new path.
+func quarantineBinary(path, bazeliskHome string) (string, error) {
+	quarantineDir := filepath.Join(bazeliskHome, "downloads", "_quarantine")
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create directory %s: %v", quarantineDir, err)
+	}
+	quarantinePath := filepath.Join(quarantineDir, time.Now().UTC().Format("20060102T150405Z")+"-"+filepath.Base(path))
+	if err := os.Rename(path, quarantinePath); err != nil {
+		return "", fmt.Errorf("could not move %s to %s: %v", path, quarantinePath, err)
+	}
+	return quarantinePath, nil
+}
+
+// rejectDownload quarantines a downloaded file that failed validation and returns an error that describes why and where it was moved.
+func rejectDownload(path, bazeliskHome string, validationErr error) error {
+	removeSidecars(path)
+	quarantinePath, err := quarantineBinary(path, bazeliskHome)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("%v (%v)", validationErr, err)
+	}
+	return fmt.Errorf("%v, moved it to %s", validationErr, quarantinePath)
+}
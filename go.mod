@@ -1,12 +1,17 @@
 module github.com/bazelbuild/bazelisk
 
-go 1.22
+go 1.22.0
 
 require (
+	github.com/ProtonMail/go-crypto v1.3.0
 	github.com/bgentry/go-netrc v0.0.0-20140422174119-9fd32a8b3d3d
 	github.com/hashicorp/go-version v1.7.0
 	github.com/mitchellh/go-homedir v1.1.0
-	golang.org/x/term v0.26.0
+	golang.org/x/term v0.29.0
 )
 
-require golang.org/x/sys v0.27.0 // indirect
+require (
+	github.com/cloudflare/circl v1.6.0 // indirect
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
@@ -0,0 +1,318 @@
+package httputil
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	netrc "github.com/bgentry/go-netrc/netrc"
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+const (
+	// AuthEnv is the name of the environment variable that stores per-host credentials, as a comma-separated list of
+	// [host pattern]=bearer:[token], [host pattern]=basic:[user]:[password], [host pattern]=header:[name]:[value] or [host pattern]=netrc:[path].
+	AuthEnv = "BAZELISK_AUTH"
+	// NetrcEnv is the name of the environment variable that stores the path of the netrc file, like for curl.
+	NetrcEnv = "NETRC"
+
+	redacted = "REDACTED"
+)
+
+var (
+	// DefaultAuthenticator provides the authentication headers for every HTTP request, if it is set.
+	DefaultAuthenticator Authenticator
+	// NetrcFile is the netrc file whose credentials are used for hosts without other credentials. If it is empty, $NETRC or ~/.netrc is used.
+	NetrcFile string
+
+	netrcCache sync.Map
+	// secretQueryParameters contains the (lower case) names of query parameters that are redacted in logs and errors.
+	secretQueryParameters = []string{"token", "access_token", "auth", "key", "password", "secret", "sig", "signature", "x-amz-credential", "x-amz-signature", "x-goog-credential", "x-goog-signature"}
+)
+
+// Authenticator returns the HTTP headers that authenticate requests to the given URL.
+type Authenticator interface {
+	Headers(url *url.URL) (http.Header, error)
+}
+
+// authenticators returns the headers of the first Authenticator that has any for a URL.
+type authenticators []Authenticator
+
+func (a authenticators) Headers(u *url.URL) (http.Header, error) {
+	for _, authenticator := range a {
+		headers, err := authenticator.Headers(u)
+		if err != nil || len(headers) > 0 {
+			return headers, err
+		}
+	}
+	return nil, nil
+}
+
+// ConfigureAuthentication replaces DefaultAuthenticator with the per-host credentials and credential helpers from the given config.
+// Per-host credentials take precedence over credential helpers. DefaultAuthenticator is reset to nil if the config has neither,
+// so that credentials from an earlier config never apply to later requests.
+func ConfigureAuthentication(config config.Config) error {
+	NetrcFile = config.Get(NetrcEnv)
+	DefaultAuthenticator = nil
+
+	var chain authenticators
+	hostCredentials, err := parseHostCredentials(config.Get(AuthEnv))
+	if err != nil {
+		return err
+	}
+	if hostCredentials != nil {
+		chain = append(chain, hostCredentials)
+	}
+	helpers, err := parseCredentialHelpers(config.Get(CredentialHelperEnv))
+	if err != nil {
+		return err
+	}
+	if helpers != nil {
+		chain = append(chain, helpers)
+	}
+	if len(chain) > 0 {
+		DefaultAuthenticator = chain
+	}
+	return nil
+}
+
+// Authenticate adds the authentication headers for the request's URL: the headers of DefaultAuthenticator, or the given
+// Authorization header value, or the credentials from the netrc file, in this order.
+func Authenticate(req *http.Request, auth string) error {
+	if DefaultAuthenticator != nil {
+		headers, err := DefaultAuthenticator.Headers(req.URL)
+		if err != nil {
+			return err
+		}
+		if len(headers) > 0 {
+			for name, values := range headers {
+				req.Header[http.CanonicalHeaderKey(name)] = values
+			}
+			return nil
+		}
+	}
+	if auth == "" {
+		auth = netrcAuth(netrcPath(), req.URL.Hostname())
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// NewClient returns an HTTP client that uses DefaultTransport and doesn't forward credentials to other hosts when following redirects.
+func NewClient() *http.Client {
+	return &http.Client{Transport: DefaultTransport, CheckRedirect: checkRedirect}
+}
+
+// checkRedirect removes the credentials from a request that is redirected to a different host, and authenticates it for that host instead.
+// Go itself only removes the Authorization and Cookie headers, but credentials from DefaultAuthenticator may use any header.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	previous := via[len(via)-1]
+	if strings.EqualFold(req.URL.Host, previous.URL.Host) {
+		return nil
+	}
+
+	req.Header.Del("Authorization")
+	if DefaultAuthenticator != nil {
+		headers, err := DefaultAuthenticator.Headers(previous.URL)
+		if err != nil {
+			return err
+		}
+		for name := range headers {
+			req.Header.Del(name)
+		}
+	}
+	return Authenticate(req, "")
+}
+
+// parseHostPattern validates a host pattern of BAZELISK_AUTH or BAZELISK_CREDENTIAL_HELPER.
+func parseHostPattern(env, pattern string) (string, error) {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if strings.Contains(strings.TrimPrefix(pattern, "*."), "*") || strings.ContainsAny(pattern, "/:") {
+		return "", fmt.Errorf("invalid %s pattern %q, expected a host name like example.com or *.example.com", env, pattern)
+	}
+	return pattern, nil
+}
+
+// matchesHost returns true if the pattern (a host name, a wildcard like "*.example.com" or empty for all hosts) matches the host.
+func matchesHost(pattern, host string) bool {
+	if pattern == "" || pattern == host {
+		return true
+	}
+	domain, ok := strings.CutPrefix(pattern, "*.")
+	return ok && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// isMoreSpecific returns true if pattern a is more specific than pattern b for the given host, assuming that both match it.
+func isMoreSpecific(a, b, host string) bool {
+	if b == host {
+		return false
+	}
+	return a == host || len(a) > len(b)
+}
+
+type hostCredential struct {
+	pattern string
+	// header and value are set for credentials that are sent directly.
+	header string
+	value  string
+	// netrcFile is set for credentials that are read from a netrc file.
+	netrcFile string
+}
+
+// hostCredentials is an Authenticator that sends the credentials with the most specific pattern that matches a URL.
+type hostCredentials []*hostCredential
+
+func parseHostCredentials(value string) (hostCredentials, error) {
+	var credentials hostCredentials
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, spec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry for %q, expected [host]=[type]:[credentials]", AuthEnv, pattern)
+		}
+		pattern, err := parseHostPattern(AuthEnv, pattern)
+		if err != nil {
+			return nil, err
+		}
+		kind, rest, _ := strings.Cut(spec, ":")
+		c := &hostCredential{pattern: pattern}
+		switch kind {
+		case "bearer":
+			c.header, c.value = "Authorization", "Bearer "+rest
+		case "basic":
+			c.header, c.value = "Authorization", "Basic "+b64.StdEncoding.EncodeToString([]byte(rest))
+		case "header":
+			name, value, ok := strings.Cut(rest, ":")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid %s entry for %s, expected header:[name]:[value]", AuthEnv, pattern)
+			}
+			c.header, c.value = name, strings.TrimSpace(value)
+		case "netrc":
+			path, err := homedir.Expand(rest)
+			if err != nil {
+				return nil, fmt.Errorf("could not expand %s netrc path for %s: %v", AuthEnv, pattern, err)
+			}
+			c.netrcFile = path
+		default:
+			// Never include the credentials themselves in the error.
+			return nil, fmt.Errorf("invalid %s entry for %s: unknown type %q, expected bearer, basic, header or netrc", AuthEnv, pattern, kind)
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials, nil
+}
+
+func (h hostCredentials) Headers(u *url.URL) (http.Header, error) {
+	host := strings.ToLower(u.Hostname())
+	var best *hostCredential
+	for _, c := range h {
+		if matchesHost(c.pattern, host) && (best == nil || isMoreSpecific(c.pattern, best.pattern, host)) {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	if best.netrcFile != "" {
+		auth := netrcAuth(best.netrcFile, host)
+		if auth == "" {
+			return nil, nil
+		}
+		return http.Header{"Authorization": []string{auth}}, nil
+	}
+	return http.Header{http.CanonicalHeaderKey(best.header): []string{best.value}}, nil
+}
+
+// netrcPath returns the path of the netrc file for hosts without other credentials.
+func netrcPath() string {
+	if NetrcFile != "" {
+		return NetrcFile
+	}
+	if path := os.Getenv(NetrcEnv); path != "" {
+		return path
+	}
+	dir, err := homedir.Dir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, ".netrc")
+}
+
+// netrcAuth returns the value of the "Authorization" header for the given host based on the given netrc file, if it has credentials for it.
+func netrcAuth(file, host string) string {
+	if file == "" {
+		return ""
+	}
+	key := file + "\x00" + host
+	if auth, ok := netrcCache.Load(key); ok {
+		return auth.(string)
+	}
+	auth, _ := tryFindNetrcFileCreds(file, host)
+	netrcCache.Store(key, auth)
+	return auth
+}
+
+// tryFindNetrcFileCreds returns base64-encoded login:password found in the given netrc file for a given `host`
+func tryFindNetrcFileCreds(file, host string) (string, error) {
+	n, err := netrc.ParseFile(file)
+	if err != nil {
+		// netrc does not exist or we can't read it
+		return "", err
+	}
+
+	m := n.FindMachine(host)
+	if m == nil {
+		// if host is not found, we should proceed without providing any Authorization header,
+		// because remote host may not have auth at all.
+		log.Printf("Skipping basic authentication for %s because no credentials found in %s", host, file)
+		return "", fmt.Errorf("could not find creds for %s in netrc %s", host, file)
+	}
+
+	log.Printf("Using basic authentication credentials for host %s from %s", host, file)
+
+	token := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", m.Login, m.Password)))
+	return fmt.Sprintf("Basic %s", token), nil
+}
+
+// RedactURL removes passwords and well-known secret query parameters (e.g. of signed URLs) from the URL, so that it can be logged.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+		changed = true
+	}
+	query := u.Query()
+	for name := range query {
+		for _, secret := range secretQueryParameters {
+			if strings.ToLower(name) == secret {
+				query.Set(name, redacted)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return rawURL
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
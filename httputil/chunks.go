@@ -0,0 +1,169 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/httputil/progress"
+)
+
+const downloadConcurrencyEnv = "BAZELISK_DOWNLOAD_CONCURRENCY"
+
+var (
+	// minChunkSize is the smallest number of bytes that is worth downloading in a separate connection.
+	minChunkSize int64 = 8 * 1024 * 1024
+)
+
+// getDownloadConcurrency returns the maximum number of connections that may be used to download a single file.
+func getDownloadConcurrency(config config.Config) (int, error) {
+	value := config.Get(downloadConcurrencyEnv)
+	if value == "" {
+		return 1, nil
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency < 1 {
+		return 0, fmt.Errorf("invalid value %q for %s, must be a positive number", value, downloadConcurrencyEnv)
+	}
+	return concurrency, nil
+}
+
+func hasPartialDownload(partialPath string) bool {
+	stat, err := os.Stat(partialPath)
+	return err == nil && stat.Size() > 0
+}
+
+// downloadInChunks downloads originURL into partialPath by fetching up to `concurrency` byte ranges in parallel.
+// It returns false (without an error) if the server does not support range requests, or if the file is too small to be split.
+func downloadInChunks(ctx context.Context, originURL, partialPath string, concurrency int, config config.Config) (bool, error) {
+	probe, err := get(ctx, originURL, "", http.Header{"Range": []string{"bytes=0-0"}})
+	if err != nil {
+		return false, err
+	}
+	err = checkContentType(originURL, probe)
+	probe.Body.Close()
+	if err != nil {
+		return false, err
+	}
+
+	if probe.StatusCode != http.StatusPartialContent {
+		return false, nil
+	}
+	// All chunks have to come from the same version of the file, which we can only ensure with a validator.
+	validator := getValidator(probe)
+	total := getContentRangeTotal(probe)
+	if validator == "" || total < 2*minChunkSize {
+		return false, nil
+	}
+
+	chunks := int64(concurrency)
+	if maxChunks := total / minChunkSize; chunks > maxChunks {
+		chunks = maxChunks
+	}
+
+	f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, fmt.Errorf("could not open %s: %v", partialPath, err)
+	}
+	defer f.Close()
+	if err := f.Truncate(total); err != nil {
+		return false, fmt.Errorf("could not allocate %d bytes for %s: %v", total, partialPath, err)
+	}
+
+	log.Printf("Downloading %s in %d parallel chunks...", RedactURL(originURL), chunks)
+	aggregate := progress.NewAggregate("Downloading", total, config)
+	chunkSize := total / chunks
+	errs := make([]error, chunks)
+	var wg sync.WaitGroup
+	for i := int64(0); i < chunks; i++ {
+		start := i * chunkSize
+		end := start + chunkSize - 1
+		if i == chunks-1 {
+			end = total - 1
+		}
+		wg.Add(1)
+		go func(i, start, end int64) {
+			defer wg.Done()
+			errs[i] = downloadChunk(ctx, originURL, validator, f, start, end, aggregate)
+		}(i, start, end)
+	}
+	wg.Wait()
+	progress.Finish(config)
+
+	if err := errors.Join(errs...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// downloadChunk writes the bytes [start, end] of originURL to the same position in f.
+// Interrupted transfers are resumed, up to MaxRetries times in a row and for at most MaxRequestDuration without progress.
+func downloadChunk(ctx context.Context, originURL, validator string, f *os.File, start, end int64, aggregate *progress.Aggregate) error {
+	var lastFailure error
+	deadline := RetryClock.Now().Add(MaxRequestDuration)
+	for attempt := 0; attempt <= MaxRetries; attempt++ {
+		headers := make(http.Header)
+		headers.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		headers.Set("If-Range", validator)
+
+		resp, err := get(ctx, originURL, "", headers)
+		if err != nil {
+			return fmt.Errorf("HTTP GET %s failed: %w", RedactURL(originURL), err)
+		}
+		if resp.StatusCode != http.StatusPartialContent || getContentRangeStart(resp) != start {
+			resp.Body.Close()
+			return &NetworkError{URL: originURL, StatusCode: resp.StatusCode, Err: fmt.Errorf("HTTP GET %s did not return bytes %d-%d (status %d), the file may have changed on the server", RedactURL(originURL), start, end, resp.StatusCode)}
+		}
+
+		written, err := io.Copy(aggregate.Writer(io.NewOffsetWriter(f, start)), io.LimitReader(resp.Body, end-start+1))
+		resp.Body.Close()
+		start += written
+		if err == nil && start <= end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		lastFailure = err
+		if written > 0 {
+			// Only count attempts that did not make any progress. Since every attempt continues where the previous one
+			// stopped, the chunk is eventually complete.
+			attempt = 0
+			deadline = RetryClock.Now().Add(MaxRequestDuration)
+		}
+		waitFor, _ := getWaitPeriod(nil, err, attempt)
+		if RetryClock.Now().Add(waitFor).After(deadline) {
+			return &NetworkError{URL: originURL, Err: fmt.Errorf("could not download bytes %d-%d of %s: no progress within %v. Most recent failure: %v", start, end, RedactURL(originURL), MaxRequestDuration, lastFailure)}
+		}
+		if attempt < MaxRetries {
+			if err := sleep(ctx, waitFor); err != nil {
+				return err
+			}
+		}
+	}
+	return &NetworkError{URL: originURL, Err: fmt.Errorf("could not download bytes %d-%d of %s after %d retries: %v", start, end, RedactURL(originURL), MaxRetries, lastFailure)}
+}
+
+// getContentRangeTotal returns the complete length in the "Content-Range" header of the given response, or -1 if it is unknown.
+func getContentRangeTotal(res *http.Response) int64 {
+	_, value, ok := strings.Cut(res.Header.Get("Content-Range"), "/")
+	if !ok {
+		return -1
+	}
+	total, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
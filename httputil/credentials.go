@@ -0,0 +1,164 @@
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/bazelbuild/bazelisk/ws"
+)
+
+const (
+	// CredentialHelperEnv is the name of the environment variable that stores the credential helpers for HTTP requests,
+	// in the format of Bazel's --credential_helper flag ([host pattern=]path), separated like PATH entries.
+	CredentialHelperEnv = "BAZELISK_CREDENTIAL_HELPER"
+)
+
+var (
+	// CredentialHelperTimeout is the maximum amount of time that a credential helper may take to respond.
+	CredentialHelperTimeout = 10 * time.Second
+	// CredentialHelperCacheDuration specifies for how long the headers of a credential helper are cached if it does not return an expiry.
+	CredentialHelperCacheDuration = 30 * time.Minute
+)
+
+// credentialHelper runs an executable that implements Bazel's credential helper protocol for URLs whose host matches the pattern.
+// See https://github.com/EngFlow/credential-helper-spec.
+type credentialHelper struct {
+	// pattern is a host name, a wildcard like "*.example.com" or empty for all hosts.
+	pattern string
+	path    string
+}
+
+type cachedHeaders struct {
+	headers http.Header
+	expires time.Time
+}
+
+// credentialHelpers is an Authenticator that runs the most specific credential helper for every URL and caches the results.
+type credentialHelpers struct {
+	helpers []*credentialHelper
+
+	mu    sync.Mutex
+	cache map[string]*cachedHeaders
+}
+
+func parseCredentialHelpers(value string) (*credentialHelpers, error) {
+	if value == "" {
+		return nil, nil
+	}
+	workspaceRoot := ""
+	if wd, err := os.Getwd(); err == nil {
+		workspaceRoot = ws.FindWorkspaceRoot(wd)
+	}
+
+	helpers := &credentialHelpers{cache: make(map[string]*cachedHeaders)}
+	for _, entry := range filepath.SplitList(value) {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, path, ok := strings.Cut(entry, "=")
+		if !ok {
+			pattern, path = "", entry
+		}
+		pattern, err := parseHostPattern(CredentialHelperEnv, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(path, "%workspace%") {
+			if workspaceRoot == "" {
+				return nil, fmt.Errorf("%s %s refers to %%workspace%%, but Bazelisk is not running in a workspace", CredentialHelperEnv, path)
+			}
+			path = strings.ReplaceAll(path, "%workspace%", workspaceRoot)
+		}
+		path, err = homedir.Expand(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s %s: %v", CredentialHelperEnv, path, err)
+		}
+		helpers.helpers = append(helpers.helpers, &credentialHelper{pattern: pattern, path: path})
+	}
+	return helpers, nil
+}
+
+// helperFor returns the credential helper with the most specific pattern that matches the host, like Bazel does.
+func (c *credentialHelpers) helperFor(host string) *credentialHelper {
+	var best *credentialHelper
+	for _, h := range c.helpers {
+		if matchesHost(h.pattern, host) && (best == nil || isMoreSpecific(h.pattern, best.pattern, host)) {
+			best = h
+		}
+	}
+	return best
+}
+
+func (c *credentialHelpers) Headers(u *url.URL) (http.Header, error) {
+	helper := c.helperFor(strings.ToLower(u.Hostname()))
+	if helper == nil {
+		return nil, nil
+	}
+
+	key := helper.path + " " + u.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.cache[key]; ok && time.Now().Before(cached.expires) {
+		return cached.headers, nil
+	}
+
+	headers, expires, err := helper.get(u)
+	if err != nil {
+		return nil, err
+	}
+	c.cache[key] = &cachedHeaders{headers: headers, expires: expires}
+	return headers, nil
+}
+
+type credentialHelperRequest struct {
+	URI string `json:"uri"`
+}
+
+type credentialHelperResponse struct {
+	Expires time.Time           `json:"expires"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// get runs `<helper> get` and returns the headers for the URL, as well as the time until which they may be cached.
+func (h *credentialHelper) get(u *url.URL) (http.Header, time.Time, error) {
+	request, err := json.Marshal(&credentialHelperRequest{URI: u.String()})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CredentialHelperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.path, "get")
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %v", CredentialHelperTimeout)
+		}
+		return nil, time.Time{}, fmt.Errorf("credential helper %s failed for %s: %v", h.path, u.Host, err)
+	}
+
+	var response credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, time.Time{}, fmt.Errorf("credential helper %s returned invalid JSON for %s: %v", h.path, u.Host, err)
+	}
+	expires := response.Expires
+	if expires.IsZero() {
+		expires = time.Now().Add(CredentialHelperCacheDuration)
+	}
+	return http.Header(response.Headers), expires, nil
+}
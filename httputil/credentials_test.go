@@ -0,0 +1,96 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+// writeCredentialHelper creates a credential helper that returns the given response and appends every request to a log file.
+func writeCredentialHelper(t *testing.T, response string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	dir := t.TempDir()
+	requests := filepath.Join(dir, "requests.log")
+	helper := filepath.Join(dir, "credential-helper")
+	script := "#!/bin/sh\n[ \"$1\" = get ] || exit 1\ncat >> " + requests + "\necho >> " + requests + "\necho '" + response + "'\n"
+	if err := os.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return helper, requests
+}
+
+func TestCredentialHelperAuthenticatesRequests(t *testing.T) {
+	t.Cleanup(func() { DefaultAuthenticator = nil })
+	helper, requests := writeCredentialHelper(t, `{"headers": {"Authorization": ["Bearer secret"], "X-Extra": ["a", "b"]}, "expires": "2999-01-01T00:00:00Z"}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || len(r.Header.Values("X-Extra")) != 2 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("authenticated"))
+	}))
+	t.Cleanup(server.Close)
+
+	if err := ConfigureAuthentication(config.Static(map[string]string{CredentialHelperEnv: helper})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		body, _, err := ReadRemoteFile(server.URL+"/file", "")
+		if err != nil || string(body) != "authenticated" {
+			t.Fatalf("Expected the request to be authenticated, but got %q (%v)", body, err)
+		}
+	}
+
+	log, err := os.ReadFile(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(log), `"uri":"`+server.URL+`/file"`) != 1 {
+		t.Fatalf("Expected the credential helper to be invoked once and its result to be cached, but got requests:\n%s", log)
+	}
+}
+
+func TestCredentialHelperPatterns(t *testing.T) {
+	helpers, err := parseCredentialHelpers(strings.Join([]string{"/bin/default", "*.example.com=/bin/wildcard", "mirror.example.com=/bin/exact", "*.internal.example.com=/bin/internal"}, string(os.PathListSeparator)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := map[string]string{
+		"mirror.example.com":       "/bin/exact",
+		"releases.example.com":     "/bin/wildcard",
+		"example.com":              "/bin/wildcard",
+		"foo.internal.example.com": "/bin/internal",
+		"releases.bazel.build":     "/bin/default",
+	}
+	for host, want := range tests {
+		if got := helpers.helperFor(host); got == nil || got.path != want {
+			t.Errorf("Expected %s to use %s, but got %v", host, want, got)
+		}
+	}
+
+	if _, err := parseCredentialHelpers("*.*.example.com=/bin/helper"); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestCredentialHelperFailure(t *testing.T) {
+	helper, _ := writeCredentialHelper(t, "not json")
+	helpers, err := parseCredentialHelpers(helper)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	u, _ := url.Parse("https://mirror.example.com/bazel?token=secret")
+	if _, err := helpers.Headers(u); err == nil || !strings.Contains(err.Error(), "invalid JSON") || strings.Contains(err.Error(), "secret") {
+		t.Fatalf("Expected an error about invalid JSON that does not contain the URL, but got %v", err)
+	}
+}
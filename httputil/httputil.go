@@ -2,22 +2,22 @@
 package httputil
 
 import (
-	b64 "encoding/base64"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
-	netrc "github.com/bgentry/go-netrc/netrc"
-	homedir "github.com/mitchellh/go-homedir"
-
 	"github.com/bazelbuild/bazelisk/config"
 	"github.com/bazelbuild/bazelisk/httputil/progress"
 )
@@ -38,6 +38,9 @@ var (
 	retryHeaders       = []string{"Retry-After", "X-RateLimit-Reset", "Rate-Limit-Reset"}
 )
 
+// unixTimestampThreshold separates a number of seconds to wait (below) from a Unix timestamp (above) in retry headers.
+const unixTimestampThreshold = 1000000000
+
 // Clock keeps track of time. It can return the current time, as well as move forward by sleeping for a certain period.
 type Clock interface {
 	Sleep(time.Duration)
@@ -55,44 +58,91 @@ func (*realClock) Now() time.Time {
 }
 
 // ReadRemoteFile returns the contents of the given file, using the supplied Authorization header value, if set. It also returns the HTTP headers.
-// If the request fails with a transient error it will retry the request for at most MaxRetries times.
+// If the request fails with a transient error or stalls for longer than ReadStallTimeout, it will retry the request for at most MaxRetries times.
 // It obeys HTTP headers such as "Retry-After" when calculating the start time of the next attempt.
-// If no such header is present, it uses an exponential backoff strategy.
+// If no such header is present, it uses an exponential backoff strategy between BaseRetryDelay and MaxRetryDelay.
 func ReadRemoteFile(url string, auth string) ([]byte, http.Header, error) {
-	res, err := get(url, auth)
+	return ReadRemoteFileContext(context.Background(), url, auth)
+}
+
+// ReadRemoteFileContext is like ReadRemoteFile, but stops waiting for the server and retrying the request once the context is done.
+func ReadRemoteFileContext(ctx context.Context, url string, auth string) ([]byte, http.Header, error) {
+	res, err := get(ctx, url, auth, nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not fetch %s: %v", url, err)
+		return nil, nil, fmt.Errorf("could not fetch %s: %w", RedactURL(url), err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
-		return nil, res.Header, fmt.Errorf("unexpected status code while reading %s: %v", url, res.StatusCode)
+		return nil, res.Header, &NetworkError{URL: url, StatusCode: res.StatusCode, Err: fmt.Errorf("unexpected status code while reading %s: %v", RedactURL(url), res.StatusCode)}
 	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, res.Header, fmt.Errorf("failed to read content at %s: %v", url, err)
+		return nil, res.Header, &NetworkError{URL: url, Err: fmt.Errorf("failed to read content at %s: %v", RedactURL(url), err)}
 	}
 	return body, res.Header, nil
 }
 
-func get(url, auth string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func get(ctx context.Context, rawURL, auth string, headers http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not create request: %v", err)
 	}
 
+	for name, values := range headers {
+		req.Header[name] = values
+	}
 	req.Header.Set("User-Agent", UserAgent)
-	if auth != "" {
-		req.Header.Set("Authorization", auth)
+	if err := Authenticate(req, auth); err != nil {
+		return nil, err
 	}
-	client := &http.Client{Transport: DefaultTransport}
+	return doWithRetries(ctx, req, rawURL)
+}
+
+// doWithRetries sends the request and retries transient failures according to the retry policy.
+// Requests with a body must set GetBody, since every attempt needs a fresh copy of the body.
+func doWithRetries(ctx context.Context, req *http.Request, rawURL string) (*http.Response, error) {
+	client := NewClient()
 	deadline := RetryClock.Now().Add(MaxRequestDuration)
 	var lastFailure string
+	var lastStatusCode int
 	for attempt := 0; attempt <= MaxRetries; attempt++ {
-		res, err := client.Do(req)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		attemptReq := req.WithContext(attemptCtx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("could not read request body: %v", err)
+			}
+			attemptReq.Body = body
+		}
+		stall := newStallDetector(ReadStallTimeout, cancel)
+		res, err := client.Do(attemptReq)
+		stall.stop()
+		if urlErr, ok := err.(*url.Error); ok {
+			// The URL may contain secrets, e.g. the signature of a signed URL.
+			urlErr.URL = RedactURL(urlErr.URL)
+			urlErr.Err = stall.wrap(urlErr.Err)
+		}
+		if err == nil {
+			if rateLimitErr := CheckRateLimit(rawURL, res); rateLimitErr != nil {
+				res.Body.Close()
+				cancel()
+				if attempt < MaxRetries && rateLimitErr.Wait(ctx) {
+					continue
+				}
+				return nil, rateLimitErr
+			}
+		}
 		if !shouldRetry(res, err) {
-			return res, err
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = &stallReader{body: res.Body, detector: stall}
+			return res, nil
 		}
 
 		if (res != nil) {
@@ -100,11 +150,17 @@ func get(url, auth string) (*http.Response, error) {
 			// See https://github.com/googleapis/google-cloud-go/issues/7440#issuecomment-1491008639
 			res.Body.Close()
 		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("request to %s was aborted: %w", RedactURL(rawURL), ctx.Err())
+		}
 
 		if err == nil {
 			lastFailure = fmt.Sprintf("HTTP %d", res.StatusCode)
+			lastStatusCode = res.StatusCode
 		} else {
 			lastFailure = err.Error()
+			lastStatusCode = 0
 		}
 		waitFor, err := getWaitPeriod(res, err, attempt)
 		if err != nil {
@@ -113,13 +169,15 @@ func get(url, auth string) (*http.Response, error) {
 
 		nextTryAt := RetryClock.Now().Add(waitFor)
 		if nextTryAt.After(deadline) {
-			return nil, fmt.Errorf("unable to complete %d requests to %s within %v. Most recent failure: %s", attempt+1, url, MaxRequestDuration, lastFailure)
+			return nil, &NetworkError{URL: rawURL, StatusCode: lastStatusCode, Err: fmt.Errorf("unable to complete %d requests to %s within %v. Most recent failure: %s", attempt+1, RedactURL(rawURL), MaxRequestDuration, lastFailure)}
 		}
 		if attempt < MaxRetries {
-			RetryClock.Sleep(waitFor)
+			if err := sleep(ctx, waitFor); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return nil, fmt.Errorf("unable to complete request to %s after %d retries. Most recent failure: %s", url, MaxRetries, lastFailure)
+	return nil, &NetworkError{URL: rawURL, StatusCode: lastStatusCode, Err: fmt.Errorf("unable to complete request to %s after %d retries. Most recent failure: %s", RedactURL(rawURL), MaxRetries, lastFailure)}
 }
 
 func shouldRetry(res *http.Response, err error) bool {
@@ -140,13 +198,17 @@ func getWaitPeriod(res *http.Response, err error, attempt int) (time.Duration, e
 			}
 		}
 	}
-	// Let's just use exponential backoff: 1s + d1, 2s + d2, 4s + d3, 8s + d4 with dx being a random value in [0ms, 500ms]
-	return time.Duration(1<<uint(attempt))*time.Second + time.Duration(rand.Intn(500))*time.Millisecond, nil
+	// Let's just use exponential backoff: by default 1s + d1, 2s + d2, 4s + d3, 8s + d4 with dx being a random value in [0ms, 500ms]
+	return getBackoff(attempt), nil
 }
 
 func parseRetryHeader(value string) (time.Duration, error) {
-	// Depending on the server the header value can be a number of seconds (how long to wait) or an actual date (when to retry).
-	if seconds, err := strconv.Atoi(value); err == nil {
+	// Depending on the server the header value can be a number of seconds (how long to wait), a Unix timestamp
+	// (like X-RateLimit-Reset of the GitHub API) or an actual date (when to retry).
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds > unixTimestampThreshold {
+			return time.Until(time.Unix(seconds, 0)), nil
+		}
 		return time.Second * time.Duration(seconds), nil
 	}
 	t, err := http.ParseTime(value)
@@ -156,129 +218,422 @@ func parseRetryHeader(value string) (time.Duration, error) {
 	return time.Until(t), nil
 }
 
-// tryFindNetrcFileCreds returns base64-encoded login:password found in ~/.netrc file for a given `host`
-func tryFindNetrcFileCreds(host string) (string, error) {
-	dir, err := homedir.Dir()
+// DownloadBinary downloads a file from the given URL into the specified location, marks it executable and returns its full path.
+// Partially downloaded files are kept in destDir (keyed by URL) when the transfer fails, and are resumed by the next attempt
+// as long as the server supports range requests and the file has not changed in the meantime.
+func DownloadBinary(originURL, destDir, destFile string, config config.Config) (string, error) {
+	return DownloadBinaryContext(context.Background(), originURL, destDir, destFile, config)
+}
+
+// DownloadBinaryContext is like DownloadBinary, but aborts the download once the context is done. The partially downloaded file is kept
+// for the next attempt, unless it was downloaded in parallel chunks (which cannot be resumed).
+func DownloadBinaryContext(ctx context.Context, originURL, destDir, destFile string, config config.Config) (string, error) {
+	err := os.MkdirAll(destDir, 0755)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("could not create directory %s: %v", destDir, err)
 	}
+	destinationPath := filepath.Join(destDir, destFile)
+
+	if _, err := os.Stat(destinationPath); err != nil {
+		log.Printf("Downloading %s...", RedactURL(originURL))
+
+		partialPath := filepath.Join(destDir, partialDownloadName(originURL))
+		concurrency, err := getDownloadConcurrency(config)
+		if err != nil {
+			return "", err
+		}
+
+		done := false
+		if concurrency > 1 && !hasPartialDownload(partialPath) {
+			done, err = downloadInChunks(ctx, originURL, partialPath, concurrency, config)
+			var contentErr *UnexpectedContentError
+			if err != nil && (ctx.Err() != nil || errors.As(err, &contentErr)) {
+				os.Remove(partialPath)
+				os.Remove(validatorPath(partialPath))
+				return "", err
+			} else if err != nil {
+				log.Printf("Parallel download of %s failed (%v), falling back to a single connection", RedactURL(originURL), err)
+				os.Remove(partialPath)
+				os.Remove(validatorPath(partialPath))
+			}
+		}
+		if !done {
+			if err := downloadWithResume(ctx, originURL, partialPath, config); err != nil {
+				return "", err
+			}
+		}
 
-	var file = filepath.Join(dir, ".netrc")
-	n, err := netrc.ParseFile(file)
+		err = os.Chmod(partialPath, 0755)
+		if err != nil {
+			return "", fmt.Errorf("could not chmod file %s: %v", partialPath, err)
+		}
+
+		err = os.Rename(partialPath, destinationPath)
+		if err != nil {
+			return "", fmt.Errorf("could not move %s to %s: %v", partialPath, destinationPath, err)
+		}
+		os.Remove(validatorPath(partialPath))
+	}
+
+	return destinationPath, nil
+}
+
+// UploadFile uploads the file at path to the given URL with an HTTP PUT request.
+func UploadFile(originURL, path string) error {
+	return UploadFileContext(context.Background(), originURL, path)
+}
+
+// UploadFileContext is like UploadFile, but aborts the upload once the context is done.
+func UploadFileContext(ctx context.Context, originURL, path string) error {
+	stat, err := os.Stat(path)
 	if err != nil {
-		// netrc does not exist or we can't read it
-		return "", err
+		return fmt.Errorf("could not stat %s: %v", path, err)
 	}
 
-	m := n.FindMachine(host)
-	if m == nil {
-		// if host is not found, we should proceed without providing any Authorization header,
-		// because remote host may not have auth at all.
-		log.Printf("Skipping basic authentication for %s because no credentials found in %s", host, file)
-		return "", fmt.Errorf("could not find creds for %s in netrc %s", host, file)
+	req, err := http.NewRequestWithContext(ctx, "PUT", originURL, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	// The file is opened again for every attempt.
+	req.GetBody = func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+	req.ContentLength = stat.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("User-Agent", UserAgent)
+	if err := Authenticate(req, ""); err != nil {
+		return err
 	}
 
-	log.Printf("Using basic authentication credentials for host %s from %s", host, file)
+	res, err := doWithRetries(ctx, req, originURL)
+	if err != nil {
+		return fmt.Errorf("HTTP PUT %s failed: %w", RedactURL(originURL), err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP PUT %s failed with error %v", RedactURL(originURL), res.StatusCode)
+	}
+	return nil
+}
 
-	token := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", m.Login, m.Password)))
-	return fmt.Sprintf("Basic %s", token), nil
+// SidecarURL returns the URL of the file that is published next to the file at originURL with the given suffix (e.g. ".sha256").
+// The suffix is appended to the path, so that query parameters such as the signature of a signed URL stay intact.
+func SidecarURL(originURL, suffix string) string {
+	u, err := url.Parse(originURL)
+	if err != nil || (u.RawQuery == "" && u.Fragment == "") {
+		return originURL + suffix
+	}
+	u.Path += suffix
+	if u.RawPath != "" {
+		u.RawPath += suffix
+	}
+	return u.String()
 }
 
-// DownloadBinary downloads a file from the given URL into the specified location, marks it executable and returns its full path.
-func DownloadBinary(originURL, destDir, destFile string, config config.Config) (string, error) {
-	err := os.MkdirAll(destDir, 0755)
+// DownloadSidecar downloads the small file that is published at originURL+suffix (e.g. a checksum) to destPath+suffix and returns its path.
+// It returns an empty path if the server does not have such a file.
+func DownloadSidecar(originURL, suffix, destPath string) (string, error) {
+	return DownloadSidecarContext(context.Background(), originURL, suffix, destPath)
+}
+
+// DownloadSidecarContext is like DownloadSidecar, but aborts the download once the context is done.
+func DownloadSidecarContext(ctx context.Context, originURL, suffix, destPath string) (string, error) {
+	sidecarURL := SidecarURL(originURL, suffix)
+	resp, err := get(ctx, sidecarURL, "", nil)
 	if err != nil {
-		return "", fmt.Errorf("could not create directory %s: %v", destDir, err)
+		return "", fmt.Errorf("HTTP GET %s failed: %w", RedactURL(sidecarURL), err)
 	}
-	destinationPath := filepath.Join(destDir, destFile)
+	defer resp.Body.Close()
 
-	if _, err := os.Stat(destinationPath); err != nil {
-		tmpfile, err := os.CreateTemp(destDir, "download")
-		if err != nil {
-			return "", fmt.Errorf("could not create temporary file: %v", err)
-		}
-		defer func() {
-			err := tmpfile.Close()
-			if err == nil {
-				os.Remove(tmpfile.Name())
-			}
-		}()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if resp.StatusCode != http.StatusOK {
+		return "", &StatusError{URL: sidecarURL, StatusCode: resp.StatusCode}
+	}
 
-		u, err := url.Parse(originURL)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", &NetworkError{URL: sidecarURL, Err: fmt.Errorf("failed to read content at %s: %v", RedactURL(sidecarURL), err)}
+	}
+
+	sidecarPath := destPath + suffix
+	if err := os.WriteFile(sidecarPath, body, 0644); err != nil {
+		return "", fmt.Errorf("could not write %s: %v", sidecarPath, err)
+	}
+	return sidecarPath, nil
+}
+
+const partialDownloadPrefix = "partial-"
+
+// partialDownloadName returns the name of the file that holds the partially downloaded contents of the given URL.
+func partialDownloadName(originURL string) string {
+	return fmt.Sprintf("%s%x", partialDownloadPrefix, sha256.Sum256([]byte(originURL)))
+}
+
+// IsPartialDownload reports whether the file with the given name in a download directory holds a partial download
+// (or its validator) that a later download of the same URL resumes.
+func IsPartialDownload(name string) bool {
+	return strings.HasPrefix(name, partialDownloadPrefix)
+}
+
+// validatorPath returns the path of the file that stores the validator (ETag or Last-Modified value) of a partial download.
+func validatorPath(partialPath string) string {
+	return partialPath + ".validator"
+}
+
+// getValidator returns a value that identifies the version of the file served in the given response, and which is
+// suitable for an "If-Range" header. Weak ETags are ignored since they must not be used for range requests.
+func getValidator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+// downloadWithResume downloads originURL into partialPath, continuing from the existing contents of partialPath if possible.
+// Transfers that break off in the middle of the body are retried with a range request, up to MaxRetries times in a row and for at most
+// MaxRequestDuration without progress. Only bytes beyond the furthest point of all previous attempts count as progress, so that a server
+// that ignores range requests and keeps failing at the same point is not retried forever.
+// The partial file is kept if the download ultimately fails.
+func downloadWithResume(ctx context.Context, originURL, partialPath string, config config.Config) error {
+	f, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", partialPath, err)
+	}
+	defer f.Close()
+
+	var validator string
+	if contents, err := os.ReadFile(validatorPath(partialPath)); err == nil {
+		validator = string(contents)
+	}
+
+	var lastFailure error
+	var furthest int64
+	deadline := RetryClock.Now().Add(MaxRequestDuration)
+	for attempt := 0; attempt <= MaxRetries; attempt++ {
+		offset, err := f.Seek(0, io.SeekEnd)
 		if err != nil {
-			// originURL supposed to be valid
-			return "", err
+			return fmt.Errorf("could not seek in %s: %v", partialPath, err)
+		}
+		if offset > 0 && validator == "" {
+			// Without a validator we cannot tell whether the server still has the same file.
+			offset = 0
 		}
 
-		log.Printf("Downloading %s...", originURL)
-
-		var auth string = ""
-		t, err := tryFindNetrcFileCreds(u.Host)
-		if err == nil {
-			// successfully parsed netrc for given host
-			auth = t
+		headers := make(http.Header)
+		if offset > 0 {
+			log.Printf("Resuming download of %s at byte %d...", RedactURL(originURL), offset)
+			headers.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			headers.Set("If-Range", validator)
 		}
 
-		resp, err := get(originURL, auth)
+		resp, err := get(ctx, originURL, "", headers)
 		if err != nil {
-			return "", fmt.Errorf("HTTP GET %s failed: %v", originURL, err)
+			return fmt.Errorf("HTTP GET %s failed: %w", RedactURL(originURL), err)
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != 200 {
-			return "", fmt.Errorf("HTTP GET %s failed with error %v", originURL, resp.StatusCode)
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if newValidator := getValidator(resp); newValidator != "" && newValidator != validator {
+				// The file changed on the server even though it honored our range request.
+				resp.Body.Close()
+				log.Printf("%s has changed on the server, discarding partial download", RedactURL(originURL))
+				if err := resetPartialDownload(f, partialPath, ""); err != nil {
+					return err
+				}
+				validator = ""
+				continue
+			}
+			if start := getContentRangeStart(resp); start != offset {
+				resp.Body.Close()
+				return &NetworkError{URL: originURL, StatusCode: resp.StatusCode, Err: fmt.Errorf("HTTP GET %s returned content starting at byte %d, but requested byte %d", RedactURL(originURL), start, offset)}
+			}
+		case http.StatusOK:
+			if err := checkContentType(originURL, resp); err != nil {
+				resp.Body.Close()
+				return err
+			}
+			// Either we did not ask for a range, or the server does not support it, or the file has changed.
+			validator = getValidator(resp)
+			offset = 0
+			if err := resetPartialDownload(f, partialPath, validator); err != nil {
+				resp.Body.Close()
+				return err
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			if err := resetPartialDownload(f, partialPath, ""); err != nil {
+				return err
+			}
+			validator = ""
+			continue
+		default:
+			resp.Body.Close()
+			return &StatusError{URL: originURL, StatusCode: resp.StatusCode}
 		}
 
-		_, err = io.Copy(
+		total := int64(-1)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		written, err := io.Copy(
 			// Add a progress bar during download.
-			progress.Writer(tmpfile, "Downloading", resp.ContentLength, config),
+			progress.ResumeWriter(f, "Downloading", offset, total, config),
 			resp.Body)
 		progress.Finish(config)
-		if err != nil {
-			return "", fmt.Errorf("could not copy from %s to %s: %v", originURL, tmpfile.Name(), err)
+		resp.Body.Close()
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return fmt.Errorf("download of %s was aborted: %w", RedactURL(originURL), ctx.Err())
 		}
 
-		err = os.Chmod(tmpfile.Name(), 0755)
-		if err != nil {
-			return "", fmt.Errorf("could not chmod file %s: %v", tmpfile.Name(), err)
+		lastFailure = err
+		if written > 0 && offset+written > furthest {
+			// Only count attempts that did not make any progress.
+			furthest = offset + written
+			attempt = 0
+			deadline = RetryClock.Now().Add(MaxRequestDuration)
 		}
-
-		tmpfile.Close()
-		err = os.Rename(tmpfile.Name(), destinationPath)
-		if err != nil {
-			return "", fmt.Errorf("could not move %s to %s: %v", tmpfile.Name(), destinationPath, err)
+		waitFor, _ := getWaitPeriod(nil, err, attempt)
+		if RetryClock.Now().Add(waitFor).After(deadline) {
+			return &NetworkError{URL: originURL, Err: fmt.Errorf("could not download %s to %s: no progress within %v. Most recent failure: %v", RedactURL(originURL), partialPath, MaxRequestDuration, lastFailure)}
+		}
+		if attempt < MaxRetries {
+			log.Printf("Download of %s was interrupted (%v), retrying in %v...", RedactURL(originURL), err, waitFor)
+			if err := sleep(ctx, waitFor); err != nil {
+				return err
+			}
 		}
 	}
+	return &NetworkError{URL: originURL, Err: fmt.Errorf("could not download %s to %s after %d retries: %v", RedactURL(originURL), partialPath, MaxRetries, lastFailure)}
+}
 
-	return destinationPath, nil
+// StatusError is returned by DownloadBinary if the server responded with an unexpected HTTP status code, e.g. 404 if it does not have the file.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP GET %s failed with error %v", RedactURL(e.URL), e.StatusCode)
+}
+
+// NetworkError is returned if a request could not be completed, e.g. because the connection broke off and all retries
+// were exhausted, or because the server kept responding with an error. Such failures are often transient.
+type NetworkError struct {
+	URL string
+	// StatusCode is the HTTP status code of the last response, or 0 if there was none.
+	StatusCode int
+	Err        error
+}
+
+func (e *NetworkError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// UnexpectedContentError is returned by DownloadBinary if the server sent a web page instead of a binary,
+// which is what captive portals and misconfigured mirrors tend to do.
+type UnexpectedContentError struct {
+	URL         string
+	ContentType string
+	// Prefix contains the first bytes of the response body.
+	Prefix []byte
+}
+
+func (e *UnexpectedContentError) Error() string {
+	return fmt.Sprintf("%s returned content of type %s instead of a binary (first bytes: %q)", RedactURL(e.URL), e.ContentType, e.Prefix)
+}
+
+// checkContentType returns an error if the given response contains an HTML page.
+func checkContentType(originURL string, res *http.Response) error {
+	contentType := res.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return nil
+	}
+	prefix := make([]byte, 64)
+	n, _ := io.ReadFull(res.Body, prefix)
+	return &UnexpectedContentError{URL: originURL, ContentType: contentType, Prefix: prefix[:n]}
+}
+
+// resetPartialDownload discards the contents of a partial download and records the validator of the file that is going to be downloaded instead.
+func resetPartialDownload(f *os.File, partialPath, validator string) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("could not truncate %s: %v", partialPath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek in %s: %v", partialPath, err)
+	}
+	if validator == "" {
+		os.Remove(validatorPath(partialPath))
+		return nil
+	}
+	if err := os.WriteFile(validatorPath(partialPath), []byte(validator), 0644); err != nil {
+		return fmt.Errorf("could not store validator of %s: %v", partialPath, err)
+	}
+	return nil
+}
+
+// getContentRangeStart returns the first byte position in the "Content-Range" header of the given response, or -1 if it is missing or invalid.
+func getContentRangeStart(res *http.Response) int64 {
+	value := strings.TrimPrefix(res.Header.Get("Content-Range"), "bytes ")
+	first, _, ok := strings.Cut(value, "-")
+	if !ok {
+		return -1
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
 }
 
 // ContentMerger is a function that merges multiple HTTP payloads into a single message.
 type ContentMerger func([][]byte) ([]byte, error)
 
 // MaybeDownload downloads a file from the given url and caches the result under bazeliskHome.
-// It skips the download if the file already exists and is not outdated.
+// It skips the download if the file already exists and is not outdated, and falls back to an outdated file if the server enforces a rate limit.
 // Parameter ´description´ is only used to provide better error messages.
 // Parameter `auth` is a value of "Authorization" HTTP header.
 func MaybeDownload(bazeliskHome, url, filename, description, auth string, merger ContentMerger) ([]byte, error) {
+	return MaybeDownloadContext(context.Background(), bazeliskHome, url, filename, description, auth, merger)
+}
+
+// MaybeDownloadContext is like MaybeDownload, but stops downloading once the context is done.
+func MaybeDownloadContext(ctx context.Context, bazeliskHome, url, filename, description, auth string, merger ContentMerger) ([]byte, error) {
 	cachePath := filepath.Join(bazeliskHome, filename)
-	if cacheStat, err := os.Stat(cachePath); err == nil {
-		if time.Since(cacheStat.ModTime()).Hours() < 1 {
-			res, err := os.ReadFile(cachePath)
-			if err != nil {
-				return nil, fmt.Errorf("could not read %s: %v", cachePath, err)
-			}
-			return res, nil
+	cacheStat, cacheErr := os.Stat(cachePath)
+	if cacheErr == nil && time.Since(cacheStat.ModTime()).Hours() < 1 {
+		res, err := os.ReadFile(cachePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", cachePath, err)
 		}
+		return res, nil
 	}
 
 	contents := make([][]byte, 0)
 	nextURL := url
 	for nextURL != "" {
 		// We could also use go-github here, but I can't get it to build with Bazel's rules_go and it pulls in a lot of dependencies.
-		body, headers, err := ReadRemoteFile(nextURL, auth)
+		body, headers, err := ReadRemoteFileContext(ctx, nextURL, auth)
 		if err != nil {
-			return nil, fmt.Errorf("could not download %s: %v", description, err)
+			var rateLimitErr *RateLimitError
+			var networkErr *NetworkError
+			// An outdated list is better than none, and it will be refreshed once the rate limit resets or the server can be
+			// reached again (e.g. on an air-gapped machine that got the list from a bundle).
+			unreachable := errors.As(err, &networkErr) && (networkErr.StatusCode == 0 || networkErr.StatusCode >= 500) && ctx.Err() == nil
+			if (errors.As(err, &rateLimitErr) || unreachable) && cacheErr == nil {
+				if res, readErr := os.ReadFile(cachePath); readErr == nil {
+					log.Printf("Warning: %v. Using the %s from %s instead.", err, description, cacheStat.ModTime().Format(time.RFC1123))
+					return res, nil
+				}
+			}
+			return nil, fmt.Errorf("could not download %s: %w", description, err)
 		}
 		contents = append(contents, body)
 		nextURL = getNextURL(headers)
@@ -286,7 +641,7 @@ func MaybeDownload(bazeliskHome, url, filename, description, auth string, merger
 
 	merged, err := merger(contents)
 	if err != nil {
-		return nil, fmt.Errorf("failed to merge %d chunks from %s: %v", len(contents), url, err)
+		return nil, fmt.Errorf("failed to merge %d chunks from %s: %v", len(contents), RedactURL(url), err)
 	}
 
 	err = os.WriteFile(cachePath, merged, 0666)
@@ -1,12 +1,22 @@
 package httputil
 
 import (
+	"bytes"
 	"errors"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
 )
 
 var (
@@ -251,3 +261,273 @@ func TestNoRetryOnPermanentError(t *testing.T) {
 		t.Fatalf("Expected no retries for permanent error, but got %d", clock.TimesSlept())
 	}
 }
+
+func serveBinary(t *testing.T, content []byte, etag string, abortFirstAt int) (*httptest.Server, *[]string) {
+	var ranges []string
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", etag)
+		if requests == 1 && abortFirstAt > 0 {
+			// Simulate a connection that breaks off in the middle of the body.
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:abortFirstAt])
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "bazel", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	restoreRetryPolicy(t)
+	DefaultTransport = http.DefaultTransport
+	RetryClock = newFakeClock()
+	MaxRetries = 4
+	return server, &ranges
+}
+
+func TestDownloadBinaryResumesInterruptedBody(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := serveBinary(t, content, `"v1"`, 4000)
+	destDir := t.TempDir()
+
+	path, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read downloaded file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected %d downloaded bytes, but got %d", len(content), len(got))
+	}
+
+	want := []string{"", "bytes=4000-"}
+	if !slices.Equal(*ranges, want) {
+		t.Fatalf("Expected requests with ranges %q, but got %q", want, *ranges)
+	}
+
+	entries, _ := os.ReadDir(destDir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the downloaded binary in %s, but got %d files", destDir, len(entries))
+	}
+}
+
+func TestDownloadBinaryResumesPartialFile(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := serveBinary(t, content, `"v1"`, 0)
+	destDir := t.TempDir()
+
+	partialPath := filepath.Join(destDir, partialDownloadName(server.URL+"/bazel"))
+	os.WriteFile(partialPath, content[:1234], 0644)
+	os.WriteFile(validatorPath(partialPath), []byte(`"v1"`), 0644)
+
+	path, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected %d downloaded bytes, but got %d", len(content), len(got))
+	}
+
+	want := []string{"bytes=1234-"}
+	if !slices.Equal(*ranges, want) {
+		t.Fatalf("Expected requests with ranges %q, but got %q", want, *ranges)
+	}
+}
+
+func TestDownloadBinaryDiscardsPartialFileIfValidatorChanged(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, _ := serveBinary(t, content, `"v2"`, 0)
+	destDir := t.TempDir()
+
+	partialPath := filepath.Join(destDir, partialDownloadName(server.URL+"/bazel"))
+	os.WriteFile(partialPath, []byte(strings.Repeat("x", 1234)), 0644)
+	os.WriteFile(validatorPath(partialPath), []byte(`"v1"`), 0644)
+
+	path, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected the partial file to be replaced with the new content, but got %q...", got[:20])
+	}
+}
+
+func TestDownloadBinaryInParallelChunks(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := serveBinary(t, content, `"v1"`, 0)
+	destDir := t.TempDir()
+
+	defer func(size int64) { minChunkSize = size }(minChunkSize)
+	minChunkSize = 1000
+
+	cfg := config.Static(map[string]string{downloadConcurrencyEnv: "4"})
+	path, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected the chunks to be assembled into the original content")
+	}
+
+	sort.Strings(*ranges)
+	want := []string{"bytes=0-0", "bytes=0-2499", "bytes=2500-4999", "bytes=5000-7499", "bytes=7500-9999"}
+	if !slices.Equal(*ranges, want) {
+		t.Fatalf("Expected requests with ranges %q, but got %q", want, *ranges)
+	}
+}
+
+func TestDownloadBinaryInParallelChunksFallsBackWithoutRangeSupport(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	DefaultTransport = http.DefaultTransport
+
+	defer func(size int64) { minChunkSize = size }(minChunkSize)
+	minChunkSize = 1000
+
+	cfg := config.Static(map[string]string{downloadConcurrencyEnv: "4"})
+	path, err := DownloadBinary(server.URL+"/bazel", t.TempDir(), "bazel", cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected %d downloaded bytes, but got %d", len(content), len(got))
+	}
+}
+
+func TestDownloadBinaryRejectsHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Please log in to continue</body></html>"))
+	}))
+	t.Cleanup(server.Close)
+	DefaultTransport = http.DefaultTransport
+	destDir := t.TempDir()
+
+	_, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", config.Null())
+	var contentErr *UnexpectedContentError
+	if !errors.As(err, &contentErr) {
+		t.Fatalf("Expected UnexpectedContentError, but got %v", err)
+	}
+	if contentErr.URL != server.URL+"/bazel" || !strings.HasPrefix(string(contentErr.Prefix), "<html>") {
+		t.Fatalf("Expected the error to contain the URL and the first bytes, but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "bazel")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the HTML page not to be stored")
+	}
+}
+
+func TestDownloadBinaryGivesUpIfServerKeepsFailingAtSamePoint(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	serveBinary(t, content, `"v1"`, 0)
+	MaxRetries = 3
+	var requests atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Ignore range requests and always break off after the same number of bytes.
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:4000])
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+
+	if _, err := DownloadBinary(failing.URL+"/bazel", t.TempDir(), "bazel", config.Null()); err == nil {
+		t.Fatalf("Expected the download to fail")
+	}
+	// Only the first attempt makes progress, so there are MaxRetries more attempts after it.
+	if n := requests.Load(); n != int32(MaxRetries)+1 {
+		t.Fatalf("Expected %d requests, but got %d", MaxRetries+1, n)
+	}
+}
+
+func TestDownloadBinaryStopsRetryingAfterDeadlineWithoutProgress(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 1000))
+	serveBinary(t, content, `"v1"`, 0)
+	MaxRetries = 100
+	MaxRequestDuration = 10 * time.Second
+	var requests atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(content[:4000])
+		panic(http.ErrAbortHandler)
+	}))
+	defer failing.Close()
+
+	_, err := DownloadBinary(failing.URL+"/bazel", t.TempDir(), "bazel", config.Null())
+	if err == nil || !strings.Contains(err.Error(), "no progress within 10s") {
+		t.Fatalf("Expected the download to give up after the deadline, but got %v", err)
+	}
+	if n := requests.Load(); n >= 100 {
+		t.Fatalf("Expected the deadline to stop the retries, but got %d requests", n)
+	}
+}
+
+func TestDownloadBinaryInChunksRejectsHTML(t *testing.T) {
+	defer func(size int64) { minChunkSize = size }(minChunkSize)
+	minChunkSize = 1000
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		// Some captive portals answer every request with a login page, even range requests.
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"portal"`)
+		w.Header().Set("Content-Range", "bytes 0-0/100000")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("<"))
+	}))
+	t.Cleanup(server.Close)
+	restoreRetryPolicy(t)
+	DefaultTransport = http.DefaultTransport
+	destDir := t.TempDir()
+
+	_, err := DownloadBinary(server.URL+"/bazel", destDir, "bazel", config.Static(map[string]string{downloadConcurrencyEnv: "4"}))
+	var contentErr *UnexpectedContentError
+	if !errors.As(err, &contentErr) {
+		t.Fatalf("Expected UnexpectedContentError, but got %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Expected only the probe request, but got %d requests", n)
+	}
+	if entries, _ := os.ReadDir(destDir); len(entries) != 0 {
+		t.Fatalf("Expected no leftover files, but got %d", len(entries))
+	}
+}
+
+func TestSidecarURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://example.com/bazel-7.4.1-linux-x86_64", want: "https://example.com/bazel-7.4.1-linux-x86_64.sha256"},
+		{url: "https://example.com/bazel?X-Amz-Signature=abc&X-Amz-Expires=60", want: "https://example.com/bazel.sha256?X-Amz-Signature=abc&X-Amz-Expires=60"},
+		{url: "https://example.com/my%20bazel?token=abc", want: "https://example.com/my%20bazel.sha256?token=abc"},
+	}
+	for _, tc := range tests {
+		if got := SidecarURL(tc.url, ".sha256"); got != tc.want {
+			t.Errorf("SidecarURL(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
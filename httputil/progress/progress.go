@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/term"
 
@@ -59,17 +60,60 @@ func showProgress(config config.Config) bool {
 
 // Writer creates an io.Writer to print the progress.
 func Writer(w io.Writer, header string, total int64, config config.Config) io.Writer {
+	return ResumeWriter(w, header, 0, total, config)
+}
+
+// ResumeWriter creates an io.Writer to print the progress of a download that already has `current` out of `total` bytes.
+func ResumeWriter(w io.Writer, header string, current, total int64, config config.Config) io.Writer {
 	if !showProgress(config) {
 		return w
 	}
 	prog := &progress{
-		header: header,
-		total:  total,
+		header:  header,
+		total:   total,
+		current: current,
 	}
 	out := io.MultiWriter(w, prog)
 	return out
 }
 
+// Aggregate shows a single progress bar for several writers that run concurrently, e.g. when downloading a file in chunks.
+type Aggregate struct {
+	mu   sync.Mutex
+	prog *progress
+}
+
+// NewAggregate creates an Aggregate whose progress bar goes up to `total` bytes.
+func NewAggregate(header string, total int64, config config.Config) *Aggregate {
+	if !showProgress(config) {
+		return &Aggregate{}
+	}
+	return &Aggregate{
+		prog: &progress{
+			header: header,
+			total:  total,
+		},
+	}
+}
+
+// Writer creates an io.Writer that writes to w and adds the number of written bytes to the aggregated progress.
+func (a *Aggregate) Writer(w io.Writer) io.Writer {
+	if a.prog == nil {
+		return w
+	}
+	return io.MultiWriter(w, &aggregateWriter{a})
+}
+
+type aggregateWriter struct {
+	aggregate *Aggregate
+}
+
+func (w *aggregateWriter) Write(buf []byte) (int, error) {
+	w.aggregate.mu.Lock()
+	defer w.aggregate.mu.Unlock()
+	return w.aggregate.prog.Write(buf)
+}
+
 // Finish writes final output after the progress bar is complete. 
 func Finish(config config.Config) {
 	if showProgress(config) {
@@ -0,0 +1,152 @@
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitMaxWaitEnv is the name of the environment variable that stores how long Bazelisk may wait for a rate limit to reset
+	// instead of failing. A value of 0 disables waiting.
+	RateLimitMaxWaitEnv = "BAZELISK_RATE_LIMIT_MAX_WAIT"
+
+	// secondaryRateLimitWait is how long GitHub wants clients to wait after hitting a secondary rate limit without a Retry-After header.
+	secondaryRateLimitWait = time.Minute
+	// lowRateLimitBudget is the number of remaining requests below which Bazelisk warns about an imminent rate limit.
+	lowRateLimitBudget = 10
+)
+
+var (
+	// RateLimitMaxWait is the maximum amount of time that a request waits for a rate limit to reset before it fails with a RateLimitError.
+	RateLimitMaxWait = time.Minute
+
+	lowBudgetWarnings sync.Map
+)
+
+// RateLimitError is returned if a server (e.g. the GitHub API) rejected a request because the client exceeded a rate limit.
+type RateLimitError struct {
+	URL string
+	// Secondary is true for limits on the request rate (e.g. GitHub's secondary rate limits), and false if the budget of requests
+	// per time window (e.g. 60 per hour for unauthenticated GitHub API requests) is exhausted.
+	Secondary bool
+	// Limit is the size of the request budget, or 0 if it is unknown.
+	Limit int
+	// Reset is the time at which the client may send requests again.
+	Reset time.Time
+	// Authenticated is true if the request was sent with credentials.
+	Authenticated bool
+}
+
+func (e *RateLimitError) Error() string {
+	var msg string
+	if e.Secondary {
+		msg = fmt.Sprintf("secondary rate limit exceeded for %s, requests are possible again at %s (in %v)", RedactURL(e.URL), e.Reset.Format(time.Kitchen), e.untilReset())
+	} else {
+		budget := "all requests"
+		if e.Limit > 0 {
+			budget = fmt.Sprintf("all %d requests", e.Limit)
+		}
+		msg = fmt.Sprintf("API rate limit exceeded for %s: %s of the current window are used up until %s (in %v)", RedactURL(e.URL), budget, e.Reset.Format(time.Kitchen), e.untilReset())
+	}
+	if !e.Authenticated {
+		msg += ", note that unauthenticated requests have a much lower limit"
+	}
+	return msg
+}
+
+func (e *RateLimitError) untilReset() time.Duration {
+	d := e.Reset.Sub(RetryClock.Now()).Round(time.Second)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Wait sleeps until the rate limit resets and returns true, unless that would take longer than RateLimitMaxWait
+// or the context is done before.
+func (e *RateLimitError) Wait(ctx context.Context) bool {
+	d := e.Reset.Sub(RetryClock.Now())
+	if d > RateLimitMaxWait {
+		return false
+	}
+	if d > 0 {
+		log.Printf("%v, waiting...", e)
+		// Reset times have a resolution of seconds, so give the server a little leeway.
+		return sleep(ctx, d+time.Second) == nil
+	}
+	return true
+}
+
+// CheckRateLimit returns a RateLimitError if the given response indicates that the request exceeded a primary or secondary rate limit
+// following the conventions of the GitHub API. Otherwise it returns nil, and the response body can still be read.
+// It also logs a warning if the remaining request budget is running low.
+func CheckRateLimit(rawURL string, res *http.Response) *RateLimitError {
+	remaining, remainingErr := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	limit, _ := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	reset := RetryClock.Now()
+	epoch, resetErr := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if resetErr == nil {
+		reset = time.Unix(epoch, 0)
+	}
+
+	if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+		if remainingErr == nil && remaining > 0 && remaining < lowRateLimitBudget {
+			warnAboutLowBudget(rawURL, res.Request, remaining, reset)
+		}
+		return nil
+	}
+
+	rateLimitErr := &RateLimitError{URL: rawURL, Limit: limit, Reset: reset}
+	if res.Request != nil {
+		rateLimitErr.Authenticated = res.Request.Header.Get("Authorization") != ""
+	}
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		// GitHub sends Retry-After for secondary rate limits.
+		rateLimitErr.Secondary = true
+		if wait, err := parseRetryHeader(retryAfter); err == nil {
+			rateLimitErr.Reset = RetryClock.Now().Add(wait)
+		}
+		return rateLimitErr
+	}
+	if remainingErr == nil && remaining == 0 {
+		// Without a reset time, retrying right away would just hit the limit again.
+		if resetErr != nil {
+			rateLimitErr.Reset = RetryClock.Now().Add(secondaryRateLimitWait)
+		}
+		return rateLimitErr
+	}
+
+	// Secondary rate limits may come without any headers, so we have to look at the message.
+	prefix, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	res.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(prefix), res.Body), Closer: res.Body}
+	if strings.Contains(strings.ToLower(string(prefix)), "rate limit") {
+		rateLimitErr.Secondary = true
+		rateLimitErr.Reset = RetryClock.Now().Add(secondaryRateLimitWait)
+		return rateLimitErr
+	}
+	return nil
+}
+
+func warnAboutLowBudget(rawURL string, req *http.Request, remaining int, reset time.Time) {
+	host := rawURL
+	if req != nil {
+		host = req.URL.Host
+	}
+	if _, warned := lowBudgetWarnings.LoadOrStore(host, true); !warned {
+		log.Printf("Warning: only %d requests to %s are left until the rate limit resets at %s", remaining, host, reset.Format(time.Kitchen))
+	}
+}
+
+// prefixedBody is a response body whose first bytes have already been read and are served from memory.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
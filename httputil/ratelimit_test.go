@@ -0,0 +1,201 @@
+package httputil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func rateLimitHeaders(remaining int, reset time.Time) map[string]string {
+	return map[string]string{
+		// The fake transport does not canonicalize header names, but real responses have canonical ones.
+		"X-Ratelimit-Limit":     "60",
+		"X-Ratelimit-Remaining": strconv.Itoa(remaining),
+		"X-Ratelimit-Reset":     strconv.FormatInt(reset.Unix(), 10),
+	}
+}
+
+func TestPrimaryRateLimitFailsIfResetIsFarAway(t *testing.T) {
+	restoreRetryPolicy(t)
+	transport, clock := setUp()
+	MaxRequestDuration = time.Hour
+	RateLimitMaxWait = time.Minute
+
+	url := "https://api.github.com/repos/bazelbuild/bazel/releases"
+	transport.AddResponse(url, 403, `{"message": "API rate limit exceeded"}`, rateLimitHeaders(0, seed.Add(30*time.Minute)))
+
+	_, _, err := ReadRemoteFile(url, "")
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("Expected a RateLimitError, but got %v", err)
+	}
+	if rateLimitErr.Secondary || rateLimitErr.Limit != 60 || rateLimitErr.Reset.Unix() != seed.Add(30*time.Minute).Unix() {
+		t.Fatalf("Unexpected rate limit %+v", rateLimitErr)
+	}
+	if !strings.Contains(err.Error(), "all 60 requests") || !strings.Contains(err.Error(), "unauthenticated") {
+		t.Fatalf("Expected a precise error message, but got %q", err)
+	}
+	if clock.TimesSlept() != 0 {
+		t.Fatalf("Expected no waiting, but slept %d times", clock.TimesSlept())
+	}
+}
+
+func TestPrimaryRateLimitWaitsIfResetIsNear(t *testing.T) {
+	restoreRetryPolicy(t)
+	transport, clock := setUp()
+	MaxRetries = 4
+	RateLimitMaxWait = time.Minute
+
+	url := "https://api.github.com/repos/bazelbuild/bazel/releases"
+	transport.AddResponse(url, 403, "", rateLimitHeaders(0, seed.Add(20*time.Second)))
+	transport.AddResponse(url, 200, "[]", rateLimitHeaders(59, seed.Add(time.Hour)))
+
+	body, _, err := ReadRemoteFile(url, "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(body) != "[]" {
+		t.Fatalf("Expected body %q, but got %q", "[]", body)
+	}
+	if clock.TimesSlept() != 1 || clock.SleepPeriods[0] < 20*time.Second {
+		t.Fatalf("Expected to wait for the reset once, but slept for %v", clock.SleepPeriods)
+	}
+}
+
+func TestPrimaryRateLimitWithoutResetWaitsBeforeRetrying(t *testing.T) {
+	restoreRetryPolicy(t)
+	transport, clock := setUp()
+	MaxRetries = 4
+	RateLimitMaxWait = 2 * secondaryRateLimitWait
+
+	url := "https://api.github.com/repos/bazelbuild/bazel/releases"
+	transport.AddResponse(url, 403, "", map[string]string{"X-Ratelimit-Remaining": "0"})
+	transport.AddResponse(url, 200, "[]", rateLimitHeaders(59, seed.Add(time.Hour)))
+
+	body, _, err := ReadRemoteFile(url, "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(body) != "[]" {
+		t.Fatalf("Expected body %q, but got %q", "[]", body)
+	}
+	if clock.TimesSlept() != 1 || clock.SleepPeriods[0] < secondaryRateLimitWait {
+		t.Fatalf("Expected to wait for %v once, but slept for %v", secondaryRateLimitWait, clock.SleepPeriods)
+	}
+}
+
+func TestSecondaryRateLimit(t *testing.T) {
+	restoreRetryPolicy(t)
+	RateLimitMaxWait = 0
+
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		wait    time.Duration
+	}{
+		{"retry after", "", map[string]string{"Retry-After": "120"}, 2 * time.Minute},
+		{"message", `{"message": "You have exceeded a secondary rate limit."}`, nil, secondaryRateLimitWait},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transport, _ := setUp()
+			url := "https://api.github.com/repos/bazelbuild/bazel/compare/a...b"
+			transport.AddResponse(url, 403, tc.body, tc.headers)
+
+			_, _, err := ReadRemoteFile(url, "")
+			var rateLimitErr *RateLimitError
+			if !errors.As(err, &rateLimitErr) {
+				t.Fatalf("Expected a RateLimitError, but got %v", err)
+			}
+			if !rateLimitErr.Secondary {
+				t.Errorf("Expected a secondary rate limit, but got %v", err)
+			}
+			if got := rateLimitErr.Reset.Sub(seed); got != tc.wait {
+				t.Errorf("Expected a reset in %v, but got %v", tc.wait, got)
+			}
+		})
+	}
+}
+
+func TestForbiddenWithoutRateLimitIsNotRetried(t *testing.T) {
+	transport, clock := setUp()
+	url := "https://example.com/secret"
+	transport.AddResponse(url, 403, "Access denied", nil)
+
+	_, _, err := ReadRemoteFile(url, "")
+	var rateLimitErr *RateLimitError
+	if err == nil || errors.As(err, &rateLimitErr) {
+		t.Fatalf("Expected a plain error, but got %v", err)
+	}
+	if clock.TimesSlept() != 0 {
+		t.Fatalf("Expected no retries, but got %d", clock.TimesSlept())
+	}
+}
+
+func TestMaybeDownloadFallsBackToOutdatedCacheWhenRateLimited(t *testing.T) {
+	restoreRetryPolicy(t)
+	transport, _ := setUp()
+	RateLimitMaxWait = 0
+
+	url := "https://api.github.com/repos/some_fork/bazel/releases"
+	transport.AddResponse(url, 403, "", rateLimitHeaders(0, seed.Add(time.Hour)))
+
+	home := t.TempDir()
+	cachePath := filepath.Join(home, "releases.json")
+	if err := os.WriteFile(cachePath, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(cachePath, old, old)
+
+	merger := func(chunks [][]byte) ([]byte, error) { return chunks[0], nil }
+	got, err := MaybeDownload(home, url, "releases.json", "list of releases", "", merger)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(got) != "cached" {
+		t.Fatalf("Expected the cached content, but got %q", got)
+	}
+
+	if _, err := MaybeDownload(t.TempDir(), url, "releases.json", "list of releases", "", merger); err == nil {
+		t.Fatal("Expected an error without a cached file")
+	}
+}
+
+func TestMaybeDownloadFallsBackToOutdatedCacheWhenUnreachable(t *testing.T) {
+	restoreRetryPolicy(t)
+	url := "https://api.github.com/repos/some_fork/bazel/releases"
+	setUpAllFailures(url, 503, 2, nil)
+
+	home := t.TempDir()
+	cachePath := filepath.Join(home, "releases.json")
+	if err := os.WriteFile(cachePath, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(cachePath, old, old)
+
+	merger := func(chunks [][]byte) ([]byte, error) { return chunks[0], nil }
+	got, err := MaybeDownload(home, url, "releases.json", "list of releases", "", merger)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(got) != "cached" {
+		t.Fatalf("Expected the cached content, but got %q", got)
+	}
+}
+
+func TestParseRetryHeaderWithUnixTimestamp(t *testing.T) {
+	got, err := parseRetryHeader(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if got < 59*time.Minute || got > time.Hour {
+		t.Fatalf("Expected a wait of about an hour, but got %v", got)
+	}
+}
@@ -0,0 +1,186 @@
+package httputil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+const (
+	// RetryAttemptsEnv is the name of the environment variable that stores how often a failing HTTP request is attempted in total.
+	RetryAttemptsEnv = "BAZELISK_RETRY_ATTEMPTS"
+	// RetryDeadlineEnv is the name of the environment variable that stores how long a request and its retries may take in total.
+	RetryDeadlineEnv = "BAZELISK_RETRY_DEADLINE"
+	// RetryBaseDelayEnv is the name of the environment variable that stores the delay before the first retry, which doubles with every further retry.
+	RetryBaseDelayEnv = "BAZELISK_RETRY_BASE_DELAY"
+	// RetryMaxDelayEnv is the name of the environment variable that stores the maximum delay between two retries.
+	RetryMaxDelayEnv = "BAZELISK_RETRY_MAX_DELAY"
+	// ReadStallTimeoutEnv is the name of the environment variable that stores how long a request may go without receiving
+	// any data before it is aborted and retried. A value of 0 disables stall detection.
+	ReadStallTimeoutEnv = "BAZELISK_READ_STALL_TIMEOUT"
+)
+
+var (
+	// BaseRetryDelay is the delay before the first retry of a failed request if the server did not ask for a specific one.
+	BaseRetryDelay = time.Second
+	// MaxRetryDelay is the maximum delay between two retries that is caused by the exponential backoff.
+	MaxRetryDelay = time.Minute
+	// ReadStallTimeout is the maximum amount of time that a request may go without receiving any data. Zero means no limit.
+	ReadStallTimeout = time.Minute
+)
+
+// defaultRetryPolicy contains the initial values of the settings that ConfigureRetries sets.
+var defaultRetryPolicy = struct {
+	maxRetries         int
+	maxRequestDuration time.Duration
+	baseRetryDelay     time.Duration
+	maxRetryDelay      time.Duration
+	readStallTimeout   time.Duration
+	rateLimitMaxWait   time.Duration
+}{MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout, RateLimitMaxWait}
+
+// ConfigureRetries sets MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout and RateLimitMaxWait
+// from the given config. Values that are not set are reset to their defaults, so that an earlier config has no effect.
+func ConfigureRetries(config config.Config) error {
+	d := defaultRetryPolicy
+	MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout, RateLimitMaxWait =
+		d.maxRetries, d.maxRequestDuration, d.baseRetryDelay, d.maxRetryDelay, d.readStallTimeout, d.rateLimitMaxWait
+
+	if value := config.Get(RetryAttemptsEnv); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < 1 {
+			return fmt.Errorf("invalid value %q for %s, must be a positive number", value, RetryAttemptsEnv)
+		}
+		MaxRetries = attempts - 1
+	}
+
+	durations := []struct {
+		env          string
+		target       *time.Duration
+		zeroDisables bool
+	}{
+		{RetryDeadlineEnv, &MaxRequestDuration, false},
+		{RetryBaseDelayEnv, &BaseRetryDelay, false},
+		{RetryMaxDelayEnv, &MaxRetryDelay, false},
+		{ReadStallTimeoutEnv, &ReadStallTimeout, true},
+		{RateLimitMaxWaitEnv, &RateLimitMaxWait, true},
+	}
+	for _, d := range durations {
+		value := config.Get(d.env)
+		if value == "" {
+			continue
+		}
+		duration, err := parseDuration(value)
+		if err != nil || duration < 0 || (duration == 0 && !d.zeroDisables) {
+			return fmt.Errorf("invalid value %q for %s, must be a positive duration like 30s or 5m", value, d.env)
+		}
+		*d.target = duration
+	}
+
+	if MaxRetryDelay < BaseRetryDelay {
+		return fmt.Errorf("%s (%v) must not be smaller than %s (%v)", RetryMaxDelayEnv, MaxRetryDelay, RetryBaseDelayEnv, BaseRetryDelay)
+	}
+	return nil
+}
+
+// parseDuration parses a Go duration like "1m30s", or a plain number of seconds.
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// getBackoff returns the exponential backoff before the given retry: BaseRetryDelay, doubled for every previous attempt and capped
+// at MaxRetryDelay, plus a random value of up to half of BaseRetryDelay.
+func getBackoff(attempt int) time.Duration {
+	delay := MaxRetryDelay
+	if attempt < 32 {
+		if d := BaseRetryDelay << uint(attempt); d > 0 && d < MaxRetryDelay {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(BaseRetryDelay/2)+1))
+}
+
+// sleep waits for the given duration using RetryClock, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if _, ok := RetryClock.(*realClock); !ok || ctx.Done() == nil {
+		RetryClock.Sleep(d)
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// stallDetector cancels a request if it does not receive any data for longer than its timeout.
+type stallDetector struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+// newStallDetector starts a timer that calls cancel after the given timeout, unless it is stopped before. A timeout of zero disables it.
+func newStallDetector(timeout time.Duration, cancel context.CancelFunc) *stallDetector {
+	d := &stallDetector{timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, func() {
+			d.stalled.Store(true)
+			cancel()
+		})
+	}
+	return d
+}
+
+func (d *stallDetector) reset() {
+	if d.timer != nil {
+		d.timer.Reset(d.timeout)
+	}
+}
+
+func (d *stallDetector) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// wrap replaces the error that is caused by cancelling a stalled request with a more helpful one.
+func (d *stallDetector) wrap(err error) error {
+	if err != nil && err != io.EOF && d.stalled.Load() {
+		return fmt.Errorf("no data received for %v (see %s)", d.timeout, ReadStallTimeoutEnv)
+	}
+	return err
+}
+
+// stallReader is a response body whose reads fail if they do not receive any data within the timeout of its stallDetector.
+// The time between reads (e.g. for writing the data to disk) does not count.
+type stallReader struct {
+	body     io.ReadCloser
+	detector *stallDetector
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.detector.reset()
+	n, err := r.body.Read(p)
+	r.detector.stop()
+	return n, r.detector.wrap(err)
+}
+
+func (r *stallReader) Close() error {
+	r.detector.stop()
+	r.detector.cancel()
+	return r.body.Close()
+}
@@ -0,0 +1,271 @@
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+func restoreRetryPolicy(t *testing.T) {
+	retries, duration, base, max, stall := MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout
+	transport, clock := DefaultTransport, RetryClock
+	t.Cleanup(func() {
+		MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout = retries, duration, base, max, stall
+		DefaultTransport, RetryClock = transport, clock
+	})
+}
+
+func TestConfigureRetries(t *testing.T) {
+	restoreRetryPolicy(t)
+
+	err := ConfigureRetries(config.Static(map[string]string{
+		RetryAttemptsEnv:    "3",
+		RetryDeadlineEnv:    "2m",
+		RetryBaseDelayEnv:   "250ms",
+		RetryMaxDelayEnv:    "10",
+		ReadStallTimeoutEnv: "0",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if MaxRetries != 2 || MaxRequestDuration != 2*time.Minute || BaseRetryDelay != 250*time.Millisecond || MaxRetryDelay != 10*time.Second || ReadStallTimeout != 0 {
+		t.Fatalf("Unexpected retry policy: %d retries, deadline %v, delays %v-%v, stall timeout %v", MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout)
+	}
+
+	// Settings of an earlier config don't apply to later ones.
+	if err := ConfigureRetries(config.Null()); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if MaxRetries != 4 || MaxRequestDuration != 30*time.Second || BaseRetryDelay != time.Second || MaxRetryDelay != time.Minute || ReadStallTimeout != time.Minute {
+		t.Fatalf("Expected the default retry policy, but got %d retries, deadline %v, delays %v-%v, stall timeout %v", MaxRetries, MaxRequestDuration, BaseRetryDelay, MaxRetryDelay, ReadStallTimeout)
+	}
+}
+
+func TestConfigureRetriesRejectsInvalidValues(t *testing.T) {
+	restoreRetryPolicy(t)
+
+	invalid := []map[string]string{
+		{RetryAttemptsEnv: "0"},
+		{RetryAttemptsEnv: "many"},
+		{RetryDeadlineEnv: "0"},
+		{RetryBaseDelayEnv: "-1s"},
+		{ReadStallTimeoutEnv: "soon"},
+		{RetryBaseDelayEnv: "10s", RetryMaxDelayEnv: "5s"},
+	}
+	for _, values := range invalid {
+		if err := ConfigureRetries(config.Static(values)); err == nil {
+			t.Errorf("Expected an error for %v", values)
+		}
+	}
+}
+
+func TestBackoffIsCappedAtMaxRetryDelay(t *testing.T) {
+	restoreRetryPolicy(t)
+	BaseRetryDelay = 100 * time.Millisecond
+	MaxRetryDelay = time.Second
+
+	wants := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for attempt, want := range wants {
+		want *= time.Millisecond
+		got := getBackoff(attempt)
+		if got < want || got > want+BaseRetryDelay/2 {
+			t.Errorf("getBackoff(%d) = %v, want %v plus up to %v", attempt, got, want, BaseRetryDelay/2)
+		}
+	}
+	if got := getBackoff(100); got < MaxRetryDelay {
+		t.Errorf("getBackoff(100) = %v, want at least %v", got, MaxRetryDelay)
+	}
+}
+
+func TestDownloadBinaryRetriesStalledBody(t *testing.T) {
+	restoreRetryPolicy(t)
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := serveBinary(t, content, `"v1"`, 0)
+	ReadStallTimeout = 200 * time.Millisecond
+
+	var requests atomic.Int32
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Send the first bytes, then stop delivering data without closing the connection.
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:3000])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer stalling.Close()
+
+	path, err := DownloadBinary(stalling.URL+"/bazel", t.TempDir(), "bazel", config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected %d downloaded bytes, but got %d", len(content), len(got))
+	}
+	if want := []string{"bytes=3000-"}; !slices.Equal(*ranges, want) {
+		t.Fatalf("Expected the stalled download to be resumed with ranges %q, but got %q", want, *ranges)
+	}
+}
+
+func TestReadRemoteFileRetriesStalledResponse(t *testing.T) {
+	restoreRetryPolicy(t)
+	ReadStallTimeout = 200 * time.Millisecond
+	DefaultTransport = http.DefaultTransport
+	clock := newFakeClock()
+	RetryClock = clock
+	MaxRetries = 2
+	MaxRequestDuration = time.Minute
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Never send the response headers.
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("the_body"))
+	}))
+	defer server.Close()
+
+	body, _, err := ReadRemoteFile(server.URL, "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if string(body) != "the_body" {
+		t.Fatalf("Expected body %q, but got %q", "the_body", body)
+	}
+	if clock.TimesSlept() != 1 {
+		t.Fatalf("Expected a single retry, not %d", clock.TimesSlept())
+	}
+}
+
+func TestDownloadBinaryContextKeepsPartialDownloadWhenCancelled(t *testing.T) {
+	restoreRetryPolicy(t)
+	content := []byte(strings.Repeat("0123456789", 1000))
+	server, ranges := serveBinary(t, content, `"v1"`, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests atomic.Int32
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:3000])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer hanging.Close()
+
+	url := hanging.URL + "/bazel"
+	destDir := t.TempDir()
+	go func() {
+		// Simulate Ctrl-C once the first bytes have been written to disk.
+		partialPath := filepath.Join(destDir, partialDownloadName(url))
+		for {
+			if stat, err := os.Stat(partialPath); err == nil && stat.Size() == 3000 {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if _, err := DownloadBinaryContext(ctx, url, destDir, "bazel", config.Null()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the download to be cancelled, but got %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Expected no retries after cancellation, but got %d requests", n)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "bazel")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no binary after a cancelled download, but got %v", err)
+	}
+
+	path, err := DownloadBinary(url, destDir, "bazel", config.Null())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, content) {
+		t.Fatalf("Expected %d downloaded bytes, but got %d", len(content), len(got))
+	}
+	if want := []string{"bytes=3000-"}; !slices.Equal(*ranges, want) {
+		t.Fatalf("Expected the cancelled download to be resumed with ranges %q, but got %q", want, *ranges)
+	}
+}
+
+func TestReadRemoteFileContextDoesNotRetryAfterCancellation(t *testing.T) {
+	restoreRetryPolicy(t)
+	transport := NewFakeTransport()
+	DefaultTransport = transport
+	clock := newFakeClock()
+	RetryClock = clock
+	MaxRetries = 5
+	MaxRequestDuration = time.Hour
+
+	url := "http://foo"
+	transport.AddResponse(url, 503, "", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := ReadRemoteFileContext(ctx, url, ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error, but got %v", err)
+	}
+	if clock.TimesSlept() != 0 {
+		t.Fatalf("Expected no retries after cancellation, but slept %d times", clock.TimesSlept())
+	}
+}
+
+func TestUploadFileRetriesWithFullBody(t *testing.T) {
+	restoreRetryPolicy(t)
+	DefaultTransport = http.DefaultTransport
+	clock := newFakeClock()
+	RetryClock = clock
+	MaxRetries = 2
+	MaxRequestDuration = time.Minute
+
+	content := strings.Repeat("0123456789", 1000)
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "bazel")
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := UploadFile(server.URL+"/cas/abc", path); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(bodies) != 2 || bodies[1] != content {
+		t.Fatalf("Expected the upload to be retried once with the whole file, but got %d requests", len(bodies))
+	}
+	if clock.TimesSlept() != 1 {
+		t.Fatalf("Expected a single retry, not %d", clock.TimesSlept())
+	}
+}
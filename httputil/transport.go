@@ -0,0 +1,192 @@
+package httputil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+const (
+	// ProxyEnv is the name of the environment variable that stores the URL of the proxy for all requests
+	// (http://, https://, socks5:// or socks5h://). If it is not set, the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables apply.
+	ProxyEnv = "BAZELISK_PROXY"
+	// NoProxyEnv is the name of the environment variable that stores a comma-separated list of hosts, domains and
+	// IP ranges that are not reached through BAZELISK_PROXY.
+	NoProxyEnv = "BAZELISK_NO_PROXY"
+	// CABundleEnv is the name of the environment variable that stores the path of a PEM file with CA certificates
+	// that are trusted in addition to the system's, e.g. for corporate TLS interception.
+	CABundleEnv = "BAZELISK_CA_BUNDLE"
+	// ClientCertEnv is the name of the environment variable that stores the path of a PEM client certificate for mTLS.
+	ClientCertEnv = "BAZELISK_CLIENT_CERT"
+	// ClientKeyEnv is the name of the environment variable that stores the path of the PEM private key of BAZELISK_CLIENT_CERT.
+	ClientKeyEnv = "BAZELISK_CLIENT_KEY"
+)
+
+var (
+	// configuredTransport is the transport that the last call of ConfigureTransport installed, and unconfiguredTransport
+	// is the one it replaced.
+	configuredTransport, unconfiguredTransport http.RoundTripper
+)
+
+// ConfigureTransport replaces DefaultTransport with a transport that uses the proxy, CA bundle and client certificate
+// from the given config. If none of them is set, the transport that an earlier call installed is removed again,
+// while transports that were installed by other means (e.g. for tests) stay untouched.
+func ConfigureTransport(config config.Config) error {
+	if configuredTransport != nil && DefaultTransport == configuredTransport {
+		DefaultTransport = unconfiguredTransport
+	}
+	configuredTransport, unconfiguredTransport = nil, nil
+
+	proxy := config.Get(ProxyEnv)
+	noProxy := config.Get(NoProxyEnv)
+	caBundle := config.Get(CABundleEnv)
+	clientCert := config.Get(ClientCertEnv)
+	clientKey := config.Get(ClientKeyEnv)
+	if proxy == "" && noProxy == "" && caBundle == "" && clientCert == "" && clientKey == "" {
+		return nil
+	}
+
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("cannot configure HTTP transport of type %T", http.DefaultTransport)
+	}
+	transport := base.Clone()
+
+	if proxy != "" {
+		proxyFunc, err := newProxyFunc(proxy, noProxy)
+		if err != nil {
+			return err
+		}
+		transport.Proxy = proxyFunc
+	} else if noProxy != "" {
+		return fmt.Errorf("%s has no effect without %s, set NO_PROXY to exclude hosts from HTTP_PROXY and HTTPS_PROXY", NoProxyEnv, ProxyEnv)
+	}
+
+	if caBundle != "" || clientCert != "" || clientKey != "" {
+		tlsConfig, err := newTLSConfig(caBundle, clientCert, clientKey)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	configuredTransport, unconfiguredTransport = transport, DefaultTransport
+	DefaultTransport = transport
+	return nil
+}
+
+func newProxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", ProxyEnv, proxy, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid %s %q: unsupported scheme %q, expected http, https, socks5 or socks5h", ProxyEnv, proxy, proxyURL.Scheme)
+	}
+
+	var exclusions []string
+	for _, entry := range strings.Split(noProxy, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			exclusions = append(exclusions, entry)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassesProxy(req.URL, exclusions) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassesProxy returns true if the host of u matches one of the exclusions, which use the syntax of NO_PROXY:
+// "*", host names (which also match their subdomains), domains with a leading "." and IP addresses or ranges in CIDR notation,
+// each optionally followed by a port.
+func bypassesProxy(u *url.URL, exclusions []string) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+
+	for _, exclusion := range exclusions {
+		if exclusion == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(exclusion); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		excludedHost, excludedPort, err := net.SplitHostPort(exclusion)
+		if err != nil {
+			excludedHost, excludedPort = exclusion, ""
+		}
+		if excludedPort != "" && excludedPort != port {
+			continue
+		}
+		excludedHost = strings.TrimPrefix(excludedHost, "*")
+		if excludedHost == host || strings.HasSuffix(host, "."+strings.TrimPrefix(excludedHost, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTLSConfig(caBundle, clientCert, clientKey string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caBundle != "" {
+		path, err := homedir.Expand(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s %s: %v", CABundleEnv, caBundle, err)
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", CABundleEnv, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s %s does not contain any PEM certificates", CABundleEnv, path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, fmt.Errorf("%s and %s must be set together", ClientCertEnv, ClientKeyEnv)
+		}
+		certPath, err := homedir.Expand(clientCert)
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s %s: %v", ClientCertEnv, clientCert, err)
+		}
+		keyPath, err := homedir.Expand(clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not expand %s %s: %v", ClientKeyEnv, clientKey, err)
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate from %s and %s: %v", ClientCertEnv, ClientKeyEnv, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
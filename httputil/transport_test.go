@@ -0,0 +1,132 @@
+package httputil
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
+
+func TestBypassesProxy(t *testing.T) {
+	exclusions := []string{"internal.example.com", ".corp.example", "10.0.0.0/8", "localhost:8080"}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "https://internal.example.com/bazel", want: true},
+		{url: "https://mirror.internal.example.com/bazel", want: true},
+		{url: "https://example.com/bazel", want: false},
+		{url: "https://releases.corp.example/bazel", want: true},
+		{url: "http://10.1.2.3/bazel", want: true},
+		{url: "http://11.1.2.3/bazel", want: false},
+		{url: "http://localhost:8080/bazel", want: true},
+		{url: "http://localhost:9090/bazel", want: false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassesProxy(u, exclusions); got != test.want {
+			t.Errorf("bypassesProxy(%s) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestConfigureTransportUsesProxy(t *testing.T) {
+	t.Cleanup(func() { DefaultTransport = http.DefaultTransport })
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("via proxy"))
+	}))
+	t.Cleanup(proxy.Close)
+
+	err := ConfigureTransport(config.Static(map[string]string{
+		ProxyEnv:   proxy.URL,
+		NoProxyEnv: "direct.example.com",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	body, _, err := ReadRemoteFile("http://releases.example.com/7.4.1/bazel", "")
+	if err != nil || string(body) != "via proxy" {
+		t.Fatalf("Expected the request to go through the proxy, but got %q (%v)", body, err)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://releases.example.com/7.4.1/bazel" {
+		t.Fatalf("Expected the proxy to receive the request, but it received %v", proxied)
+	}
+}
+
+func TestConfigureTransportRemovesEarlierConfiguration(t *testing.T) {
+	restoreRetryPolicy(t)
+	fake := NewFakeTransport()
+	DefaultTransport = fake
+
+	if err := ConfigureTransport(config.Static(map[string]string{ProxyEnv: "http://proxy.example.com:3128"})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if DefaultTransport == fake {
+		t.Fatal("Expected the transport to be replaced")
+	}
+
+	if err := ConfigureTransport(config.Null()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if DefaultTransport != fake {
+		t.Fatalf("Expected the transport of the earlier config to be removed, but got %T", DefaultTransport)
+	}
+	// Transports that were installed by other means are kept.
+	if err := ConfigureTransport(config.Null()); err != nil || DefaultTransport != fake {
+		t.Fatalf("Expected the transport to be kept, but got %T (%v)", DefaultTransport, err)
+	}
+}
+
+func TestConfigureTransportTrustsCABundle(t *testing.T) {
+	t.Cleanup(func() { DefaultTransport = http.DefaultTransport })
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("trusted"))
+	}))
+	t.Cleanup(server.Close)
+
+	if _, _, err := ReadRemoteFile(server.URL, ""); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("Expected the self-signed certificate to be rejected, but got %v", err)
+	}
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caBundle, certificate, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureTransport(config.Static(map[string]string{CABundleEnv: caBundle})); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if body, _, err := ReadRemoteFile(server.URL, ""); err != nil || string(body) != "trusted" {
+		t.Fatalf("Expected the certificate in %s to be trusted, but got %q (%v)", CABundleEnv, body, err)
+	}
+}
+
+func TestConfigureTransportRejectsInvalidSettings(t *testing.T) {
+	t.Cleanup(func() { DefaultTransport = http.DefaultTransport })
+
+	tests := []map[string]string{
+		{ProxyEnv: "ftp://proxy.example.com"},
+		{NoProxyEnv: "example.com"},
+		{ClientCertEnv: "client.pem"},
+		{CABundleEnv: filepath.Join(t.TempDir(), "missing.pem")},
+	}
+	for _, values := range tests {
+		if err := ConfigureTransport(config.Static(values)); err == nil {
+			t.Errorf("Expected an error for %v", values)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"strings"
 
 	"github.com/bazelbuild/bazelisk/config"
 	"github.com/bazelbuild/bazelisk/versions"
@@ -31,47 +32,119 @@ var supportedPlatforms = map[string]*platform{
 	},
 }
 
-// GetPlatform returns a Bazel CI-compatible platform identifier for the current operating system.
-// TODO(fweikert): raise an error for unsupported platforms
-func GetPlatform() (string, error) {
-	platform := supportedPlatforms[runtime.GOOS]
-	arch := runtime.GOARCH
-	if arch == "arm64" {
+// Platform is an operating system and machine architecture for which Bazel binaries are published, e.g. linux-x86_64.
+type Platform struct {
+	// OS is "darwin", "linux" or "windows".
+	OS string
+	// Arch is "arm64" or "x86_64".
+	Arch string
+}
+
+// String returns the platform in the format that is used in the file names of Bazel binaries, e.g. "darwin-arm64".
+func (p Platform) String() string {
+	return p.OS + "-" + p.Arch
+}
+
+// ExecutableFilenameSuffix returns the extension for binaries on the platform.
+func (p Platform) ExecutableFilenameSuffix() string {
+	if p.OS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
+
+// CIName returns a Bazel CI-compatible platform identifier for the platform.
+func (p Platform) CIName() (string, error) {
+	platform, ok := supportedPlatforms[p.OS]
+	if !ok {
+		return "", fmt.Errorf("unsupported operating system %q, must be Linux, macOS or Windows", p.OS)
+	}
+	if p.Arch == "arm64" {
 		if platform.HasArm64Binary {
 			return platform.Name + "_arm64", nil
 		}
-		return "", fmt.Errorf("arm64 %s is unsupported", runtime.GOOS)
+		return "", fmt.Errorf("arm64 %s is unsupported", p.OS)
 	}
 
 	return platform.Name, nil
 }
 
+// CurrentPlatform returns the platform of the current machine.
+func CurrentPlatform() (Platform, error) {
+	osName, err := DetermineOperatingSystem()
+	if err != nil {
+		return Platform{}, err
+	}
+	machineName, err := determineMachineName()
+	if err != nil {
+		return Platform{}, err
+	}
+	return Platform{OS: osName, Arch: machineName}, nil
+}
+
+// ParsePlatform parses a platform like "linux-x86_64" or "darwin-arm64". It also accepts Go's names ("amd64") and "macos".
+func ParsePlatform(value string) (Platform, error) {
+	osName, machineName, ok := strings.Cut(strings.ToLower(value), "-")
+	if !ok {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected <os>-<arch> such as linux-x86_64 or darwin-arm64", value)
+	}
+	switch osName {
+	case "macos":
+		osName = "darwin"
+	case "darwin", "linux", "windows":
+	default:
+		return Platform{}, fmt.Errorf("unsupported operating system %q in platform %q, must be darwin, linux or windows", osName, value)
+	}
+	switch machineName {
+	case "amd64":
+		machineName = "x86_64"
+	case "aarch64":
+		machineName = "arm64"
+	case "arm64", "x86_64":
+	default:
+		return Platform{}, fmt.Errorf("unsupported machine architecture %q in platform %q, must be arm64 or x86_64", machineName, value)
+	}
+	return Platform{OS: osName, Arch: machineName}, nil
+}
+
+// GetPlatform returns a Bazel CI-compatible platform identifier for the current operating system.
+// TODO(fweikert): raise an error for unsupported platforms
+func GetPlatform() (string, error) {
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}.CIName()
+}
+
 // DetermineExecutableFilenameSuffix returns the extension for binaries on the current operating system.
 func DetermineExecutableFilenameSuffix() string {
-	filenameSuffix := ""
-	if runtime.GOOS == "windows" {
-		filenameSuffix = ".exe"
-	}
-	return filenameSuffix
+	return Platform{OS: runtime.GOOS}.ExecutableFilenameSuffix()
 }
 
 // DetermineArchitecture returns the architecture of the current machine.
 func DetermineArchitecture(osName, version string) (string, error) {
-	var machineName string
+	machineName, err := determineMachineName()
+	if err != nil {
+		return "", err
+	}
+	return Platform{OS: osName, Arch: machineName}.ArchitectureForVersion(version), nil
+}
+
+// ArchitectureForVersion returns the architecture of the Bazel binary of the given version for the platform,
+// which may differ from the platform's architecture if there is no native binary.
+func (p Platform) ArchitectureForVersion(version string) string {
+	if p.OS == "darwin" {
+		return DarwinFallback(p.Arch, version)
+	}
+	return p.Arch
+}
+
+func determineMachineName() (string, error) {
 	switch runtime.GOARCH {
 	case "amd64":
-		machineName = "x86_64"
+		return "x86_64", nil
 	case "arm64":
-		machineName = "arm64"
+		return "arm64", nil
 	default:
 		return "", fmt.Errorf("unsupported machine architecture %q, must be arm64 or x86_64", runtime.GOARCH)
 	}
-
-	if osName == "darwin" {
-		machineName = DarwinFallback(machineName, version)
-	}
-
-	return machineName, nil
 }
 
 // DetermineOperatingSystem returns the name of the operating system.
@@ -86,6 +159,15 @@ func DetermineOperatingSystem() (string, error) {
 
 // DetermineBazelFilename returns the correct file name of a local Bazel binary.
 func DetermineBazelFilename(version string, includeSuffix bool, config config.Config) (string, error) {
+	platform, err := CurrentPlatform()
+	if err != nil {
+		return "", err
+	}
+	return DetermineBazelFilenameForPlatform(version, platform, includeSuffix, config)
+}
+
+// DetermineBazelFilenameForPlatform returns the file name of the Bazel binary for the given platform.
+func DetermineBazelFilenameForPlatform(version string, platform Platform, includeSuffix bool, config config.Config) (string, error) {
 	flavor := "bazel"
 
 	bazeliskNojdk := config.Get("BAZELISK_NOJDK")
@@ -94,22 +176,12 @@ func DetermineBazelFilename(version string, includeSuffix bool, config config.Co
 		flavor = "bazel_nojdk"
 	}
 
-	osName, err := DetermineOperatingSystem()
-	if err != nil {
-		return "", err
-	}
-
-	machineName, err := DetermineArchitecture(osName, version)
-	if err != nil {
-		return "", err
-	}
-
 	var filenameSuffix string
 	if includeSuffix {
-		filenameSuffix = DetermineExecutableFilenameSuffix()
+		filenameSuffix = platform.ExecutableFilenameSuffix()
 	}
 
-	return fmt.Sprintf("%s-%s-%s-%s%s", flavor, version, osName, machineName, filenameSuffix), nil
+	return fmt.Sprintf("%s-%s-%s-%s%s", flavor, version, platform.OS, platform.ArchitectureForVersion(version), filenameSuffix), nil
 }
 
 // DarwinFallback Darwin arm64 was supported since 4.1.0, before 4.1.0, fall back to x86_64
@@ -1,6 +1,10 @@
 package platforms
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/bazelbuild/bazelisk/config"
+)
 
 func TestDarwinFallback(t *testing.T) {
 	type args struct {
@@ -54,3 +58,52 @@ func TestDarwinFallback(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Platform
+		wantErr bool
+	}{
+		{value: "linux-x86_64", want: Platform{OS: "linux", Arch: "x86_64"}},
+		{value: "macos-aarch64", want: Platform{OS: "darwin", Arch: "arm64"}},
+		{value: "windows-amd64", want: Platform{OS: "windows", Arch: "x86_64"}},
+		{value: "linux", wantErr: true},
+		{value: "freebsd-x86_64", wantErr: true},
+		{value: "linux-s390x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParsePlatform(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetermineBazelFilenameForPlatform(t *testing.T) {
+	tests := []struct {
+		platform Platform
+		version  string
+		want     string
+	}{
+		{platform: Platform{OS: "linux", Arch: "arm64"}, version: "7.4.1", want: "bazel-7.4.1-linux-arm64"},
+		{platform: Platform{OS: "windows", Arch: "x86_64"}, version: "7.4.1", want: "bazel-7.4.1-windows-x86_64.exe"},
+		{platform: Platform{OS: "darwin", Arch: "arm64"}, version: "4.0.0", want: "bazel-4.0.0-darwin-x86_64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := DetermineBazelFilenameForPlatform(tt.version, tt.platform, true, config.Null())
+			if err != nil {
+				t.Fatalf("DetermineBazelFilenameForPlatform() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("DetermineBazelFilenameForPlatform() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,12 +4,12 @@
 package repositories
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/bazelbuild/bazelisk/config"
 	"github.com/bazelbuild/bazelisk/core"
@@ -32,11 +32,16 @@ type GCSRepo struct{}
 
 // GetLTSVersions returns the versions of all available Bazel releases in this repository that match the given filter.
 func (gcs *GCSRepo) GetLTSVersions(bazeliskHome string, opts *core.FilterOpts) ([]string, error) {
-	history, err := getVersionHistoryFromGCS()
+	return gcs.GetLTSVersionsContext(context.Background(), bazeliskHome, opts)
+}
+
+// GetLTSVersionsContext is like GetLTSVersions, but aborts once the context is done.
+func (gcs *GCSRepo) GetLTSVersionsContext(ctx context.Context, bazeliskHome string, opts *core.FilterOpts) ([]string, error) {
+	history, err := getVersionHistoryFromGCS(ctx)
 	if err != nil {
 		return []string{}, err
 	}
-	matches, err := gcs.matchingVersions(history, opts)
+	matches, err := gcs.matchingVersions(ctx, history, opts)
 	if err != nil {
 		return []string{}, err
 	}
@@ -50,10 +55,10 @@ func (gcs *GCSRepo) GetLTSVersions(bazeliskHome string, opts *core.FilterOpts) (
 	return matches, nil
 }
 
-func getVersionHistoryFromGCS() ([]string, error) {
-	prefixes, err := listDirectoriesInBucket("")
+func getVersionHistoryFromGCS(ctx context.Context) ([]string, error) {
+	prefixes, err := listDirectoriesInBucket(ctx, "")
 	if err != nil {
-		return []string{}, fmt.Errorf("could not list Bazel versions in GCS bucket: %v", err)
+		return []string{}, fmt.Errorf("could not list Bazel versions in GCS bucket: %w", err)
 	}
 
 	available := getVersionsFromGCSPrefixes(prefixes)
@@ -61,7 +66,7 @@ func getVersionHistoryFromGCS() ([]string, error) {
 	return sorted, nil
 }
 
-func listDirectoriesInBucket(prefix string) ([]string, error) {
+func listDirectoriesInBucket(ctx context.Context, prefix string) ([]string, error) {
 	baseURL := "https://www.googleapis.com/storage/v1/b/bazel/o?delimiter=/"
 	if prefix != "" {
 		baseURL = fmt.Sprintf("%s&prefix=%s", baseURL, prefix)
@@ -75,23 +80,11 @@ func listDirectoriesInBucket(prefix string) ([]string, error) {
 			url = fmt.Sprintf("%s&pageToken=%s", baseURL, nextPageToken)
 		}
 
-		var content []byte
-		var err error
-		// Theoretically, this should always work, but we've seen transient
-		// errors on Bazel CI, so we retry a few times to work around this.
-		// https://github.com/bazelbuild/continuous-integration/issues/1627
-		waitTime := 100 * time.Microsecond
-		for attempt := 0; attempt < 5; attempt++ {
-			content, _, err = httputil.ReadRemoteFile(url, "")
-			if err == nil {
-				break
-			}
-			time.Sleep(waitTime)
-			waitTime *= 2
-		}
-
+		// ReadRemoteFile retries transient errors according to the configured retry policy.
+		// We've seen such errors on Bazel CI: https://github.com/bazelbuild/continuous-integration/issues/1627
+		content, _, err := httputil.ReadRemoteFileContext(ctx, url, "")
 		if err != nil {
-			return nil, fmt.Errorf("could not list GCS objects at %s: %v", url, err)
+			return nil, fmt.Errorf("could not list GCS objects at %s: %w", httputil.RedactURL(url), err)
 		}
 
 		var response GcsListResponse
@@ -131,7 +124,7 @@ func getVersionsFromGCSPrefixes(versions []string) []string {
 	return result
 }
 
-func (gcs *GCSRepo) matchingVersions(history []string, opts *core.FilterOpts) ([]string, error) {
+func (gcs *GCSRepo) matchingVersions(ctx context.Context, history []string, opts *core.FilterOpts) ([]string, error) {
 	descendingMatches := make([]string, 0)
 	// history is a list of base versions in ascending order (i.e. X.Y.Z, no rolling releases or candidates).
 	for hpos := len(history) - 1; hpos >= 0; hpos-- {
@@ -150,9 +143,9 @@ func (gcs *GCSRepo) matchingVersions(history []string, opts *core.FilterOpts) ([
 
 		// Append slash to match directories
 		bucket := fmt.Sprintf("%s/", history[hpos])
-		prefixes, err := listDirectoriesInBucket(bucket)
+		prefixes, err := listDirectoriesInBucket(ctx, bucket)
 		if err != nil {
-			return []string{}, fmt.Errorf("could not list LTS releases/candidates: %v", err)
+			return []string{}, fmt.Errorf("could not list LTS releases/candidates: %w", err)
 		}
 
 		// Ascending list of rc versions, followed by the release version (if it exists) and a rolling identifier (if there are rolling releases).
@@ -181,8 +174,13 @@ func getTrack(version string) (int, error) {
 }
 
 // DownloadLTS downloads the given Bazel LTS release (candidate) into the specified location and returns the absolute path.
-func (gcs *GCSRepo) DownloadLTS(version, destDir, destFile string, config config.Config) (string, error) {
-	srcFile, err := platforms.DetermineBazelFilename(version, true, config)
+func (gcs *GCSRepo) DownloadLTS(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return gcs.DownloadLTSContext(context.Background(), version, platform, destDir, destFile, config)
+}
+
+// DownloadLTSContext is like DownloadLTS, but aborts once the context is done.
+func (gcs *GCSRepo) DownloadLTSContext(ctx context.Context, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	srcFile, err := platforms.DetermineBazelFilenameForPlatform(version, platform, true, config)
 	if err != nil {
 		return "", err
 	}
@@ -196,16 +194,21 @@ func (gcs *GCSRepo) DownloadLTS(version, destDir, destFile string, config config
 	}
 
 	url := fmt.Sprintf("%s/%s/%s/%s", ltsBaseURL, baseVersion, folder, srcFile)
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	return core.DownloadBinaryWithSidecarsContext(ctx, url, destDir, destFile, config)
 }
 
 // CommitRepo
 
 // GetLastGreenCommit returns the most recent commit at which a Bazel binary is successfully built.
 func (gcs *GCSRepo) GetLastGreenCommit(bazeliskHome string) (string, error) {
-	content, _, err := httputil.ReadRemoteFile(lastGreenCommitURL, "")
+	return gcs.GetLastGreenCommitContext(context.Background(), bazeliskHome)
+}
+
+// GetLastGreenCommitContext is like GetLastGreenCommit, but aborts once the context is done.
+func (gcs *GCSRepo) GetLastGreenCommitContext(ctx context.Context, bazeliskHome string) (string, error) {
+	content, _, err := httputil.ReadRemoteFileContext(ctx, lastGreenCommitURL, "")
 	if err != nil {
-		return "", fmt.Errorf("could not determine last green commit: %v", err)
+		return "", fmt.Errorf("could not determine last green commit: %w", err)
 	}
 
 	// Validate the content does look like a commit hash
@@ -217,28 +220,38 @@ func (gcs *GCSRepo) GetLastGreenCommit(bazeliskHome string) (string, error) {
 	return commit, nil
 }
 
-// DownloadAtCommit downloads a Bazel binary built at the given commit into the specified location and returns the absolute path.
-func (gcs *GCSRepo) DownloadAtCommit(commit, destDir, destFile string, config config.Config) (string, error) {
+// DownloadAtCommit downloads a Bazel binary for the given platform built at the given commit into the specified location and returns the absolute path.
+func (gcs *GCSRepo) DownloadAtCommit(commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return gcs.DownloadAtCommitContext(context.Background(), commit, platform, destDir, destFile, config)
+}
+
+// DownloadAtCommitContext is like DownloadAtCommit, but aborts once the context is done.
+func (gcs *GCSRepo) DownloadAtCommitContext(ctx context.Context, commit string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
 	log.Printf("Using unreleased version at commit %s", commit)
-	platform, err := platforms.GetPlatform()
+	ciName, err := platform.CIName()
 	if err != nil {
 		return "", err
 	}
-	url := fmt.Sprintf("%s/%s/%s/bazel", commitBaseURL, platform, commit)
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	url := fmt.Sprintf("%s/%s/%s/bazel", commitBaseURL, ciName, commit)
+	return core.DownloadBinaryWithSourceContext(ctx, url, destDir, destFile, config)
 }
 
 // RollingRepo
 
 // GetRollingVersions returns a list of all available rolling release versions for the newest release.
 func (gcs *GCSRepo) GetRollingVersions(bazeliskHome string) ([]string, error) {
-	history, err := getVersionHistoryFromGCS()
+	return gcs.GetRollingVersionsContext(context.Background(), bazeliskHome)
+}
+
+// GetRollingVersionsContext is like GetRollingVersions, but aborts once the context is done.
+func (gcs *GCSRepo) GetRollingVersionsContext(ctx context.Context, bazeliskHome string) ([]string, error) {
+	history, err := getVersionHistoryFromGCS(ctx)
 	if err != nil {
 		return []string{}, err
 	}
 
 	newest := history[len(history)-1]
-	versions, err := listDirectoriesInBucket(newest + "/rolling/")
+	versions, err := listDirectoriesInBucket(ctx, newest+"/rolling/")
 	if err != nil {
 		return []string{}, err
 	}
@@ -253,14 +266,19 @@ func (gcs *GCSRepo) GetRollingVersions(bazeliskHome string) ([]string, error) {
 	return releases, nil
 }
 
-// DownloadRolling downloads the given Bazel version into the specified location and returns the absolute path.
-func (gcs *GCSRepo) DownloadRolling(version, destDir, destFile string, config config.Config) (string, error) {
-	srcFile, err := platforms.DetermineBazelFilename(version, true, config)
+// DownloadRolling downloads the given Bazel version for the given platform into the specified location and returns the absolute path.
+func (gcs *GCSRepo) DownloadRolling(version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return gcs.DownloadRollingContext(context.Background(), version, platform, destDir, destFile, config)
+}
+
+// DownloadRollingContext is like DownloadRolling, but aborts once the context is done.
+func (gcs *GCSRepo) DownloadRollingContext(ctx context.Context, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	srcFile, err := platforms.DetermineBazelFilenameForPlatform(version, platform, true, config)
 	if err != nil {
 		return "", err
 	}
 
 	releaseVersion := strings.Split(version, "-")[0]
 	url := fmt.Sprintf("%s/%s/rolling/%s/%s", ltsBaseURL, releaseVersion, version, srcFile)
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	return core.DownloadBinaryWithSidecarsContext(ctx, url, destDir, destFile, config)
 }
@@ -1,10 +1,13 @@
 package repositories
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/bazelbuild/bazelisk/config"
+	"github.com/bazelbuild/bazelisk/core"
 	"github.com/bazelbuild/bazelisk/httputil"
 	"github.com/bazelbuild/bazelisk/platforms"
 )
@@ -27,10 +30,15 @@ func CreateGitHubRepo(token string) *GitHubRepo {
 
 // GetVersions returns the versions of all available Bazel binaries in the given fork.
 func (gh *GitHubRepo) GetVersions(bazeliskHome, bazelFork string) ([]string, error) {
-	return gh.getFilteredVersions(bazeliskHome, bazelFork, false)
+	return gh.GetVersionsContext(context.Background(), bazeliskHome, bazelFork)
 }
 
-func (gh *GitHubRepo) getFilteredVersions(bazeliskHome, bazelFork string, wantPrerelease bool) ([]string, error) {
+// GetVersionsContext is like GetVersions, but aborts once the context is done.
+func (gh *GitHubRepo) GetVersionsContext(ctx context.Context, bazeliskHome, bazelFork string) ([]string, error) {
+	return gh.getFilteredVersions(ctx, bazeliskHome, bazelFork, false)
+}
+
+func (gh *GitHubRepo) getFilteredVersions(ctx context.Context, bazeliskHome, bazelFork string, wantPrerelease bool) ([]string, error) {
 	parse := func(data []byte) ([]gitHubRelease, error) {
 		var releases []gitHubRelease
 		if err := json.Unmarshal(data, &releases); err != nil {
@@ -57,9 +65,13 @@ func (gh *GitHubRepo) getFilteredVersions(bazeliskHome, bazelFork string, wantPr
 	if gh.token != "" {
 		auth = fmt.Sprintf("token %s", gh.token)
 	}
-	releasesJSON, err := httputil.MaybeDownload(bazeliskHome, url, bazelFork+"-releases.json", "list of Bazel releases from github.com/"+bazelFork, auth, merger)
+	releasesJSON, err := httputil.MaybeDownloadContext(ctx, bazeliskHome, url, bazelFork+"-releases.json", "list of Bazel releases from github.com/"+bazelFork, auth, merger)
 	if err != nil {
-		return []string{}, fmt.Errorf("unable to determine '%s' releases: %v", bazelFork, err)
+		var rateLimitErr *httputil.RateLimitError
+		if errors.As(err, &rateLimitErr) && gh.token == "" {
+			return []string{}, fmt.Errorf("unable to determine '%s' releases: %w. Set BAZELISK_GITHUB_TOKEN, BAZELISK_GITHUB_TOKEN_COMMAND or GITHUB_TOKEN to get a higher limit", bazelFork, err)
+		}
+		return []string{}, fmt.Errorf("unable to determine '%s' releases: %w", bazelFork, err)
 	}
 
 	if len(releases) == 0 {
@@ -85,11 +97,16 @@ type gitHubRelease struct {
 }
 
 // DownloadVersion downloads a Bazel binary for the given version and fork to the specified location and returns the absolute path.
-func (gh *GitHubRepo) DownloadVersion(fork, version, destDir, destFile string, config config.Config) (string, error) {
-	filename, err := platforms.DetermineBazelFilename(version, true, config)
+func (gh *GitHubRepo) DownloadVersion(fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	return gh.DownloadVersionContext(context.Background(), fork, version, platform, destDir, destFile, config)
+}
+
+// DownloadVersionContext is like DownloadVersion, but aborts once the context is done.
+func (gh *GitHubRepo) DownloadVersionContext(ctx context.Context, fork, version string, platform platforms.Platform, destDir, destFile string, config config.Config) (string, error) {
+	filename, err := platforms.DetermineBazelFilenameForPlatform(version, platform, true, config)
 	if err != nil {
 		return "", err
 	}
 	url := fmt.Sprintf(urlPattern, fork, version, filename)
-	return httputil.DownloadBinary(url, destDir, destFile, config)
+	return core.DownloadBinaryWithSourceContext(ctx, url, destDir, destFile, config)
 }